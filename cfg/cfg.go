@@ -66,6 +66,18 @@ func readSection(b *scanner) (name string, sec section, err error) {
 	if !b.more() {
 		return
 	}
+
+	// A section may have an argument, like "users example.com {",
+	// which becomes a part of its name: "users example.com".
+	if b.next() != '{' {
+		arg := readName(b)
+		if arg == "" {
+			err = fmt.Errorf("'{' expected after %s", name)
+			return
+		}
+		name += " " + arg
+		b.skipSpaces()
+	}
 	b.expect('{')
 	b.skipSpaces()
 
@@ -84,7 +96,7 @@ func readSection(b *scanner) (name string, sec section, err error) {
 
 		val := ""
 		for b.next() != '\n' && b.next() != '\r' {
-			val += string(b.get())
+			val += string([]byte{b.get()})
 		}
 
 		// If this is a key without a value, put something non-empty there
@@ -110,14 +122,22 @@ func isDigit(ch byte) bool {
 	return ch >= '0' && ch <= '9'
 }
 
+// readName reads a section name or a key. Names may contain
+// UTF-8 characters, so that they can be used as user names in
+// internationalized addresses.
 func readName(b *scanner) string {
 	name := ""
-	if !isAlpha(b.next()) {
+	if !isAlpha(b.next()) && !isUTF8(b.next()) {
 		return name
 	}
 
-	for isAlpha(b.next()) || isDigit(b.next()) || b.next() == '-' {
-		name += string(b.get())
+	for isAlpha(b.next()) || isDigit(b.next()) || isUTF8(b.next()) || strings.IndexByte("-_.", b.next()) >= 0 {
+		// Bytes are added as they are, not as runes.
+		name += string([]byte{b.get()})
 	}
 	return name
 }
+
+func isUTF8(ch byte) bool {
+	return ch >= 0x80
+}
@@ -78,3 +78,29 @@ func TestParsing2(t *testing.T) {
 		t.Fatal("expected sg-web.run to be 'yarn dev'")
 	}
 }
+
+func TestUTF8Names(t *testing.T) {
+	cfg, err := parseString("users {\n\tjosé plain pässword\n\tjoe_smith plain 123\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg["users"]["josé"] != "plain pässword" {
+		t.Errorf("unexpected users: %q", cfg["users"])
+	}
+	if cfg["users"]["joe_smith"] != "plain 123" {
+		t.Errorf("unexpected users: %q", cfg["users"])
+	}
+}
+
+func TestSectionArguments(t *testing.T) {
+	cfg, err := parseString("users {\n\tbob\n}\nusers example.com {\n\tjoe\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg["users"]["bob"] == "" || cfg["users example.com"]["joe"] == "" {
+		t.Errorf("unexpected sections: %q", cfg)
+	}
+	if cfg["users"]["joe"] != "" {
+		t.Errorf("sections are mixed up: %q", cfg)
+	}
+}
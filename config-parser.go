@@ -3,16 +3,21 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/gaswelder/ring2/cfg"
 	"github.com/gaswelder/ring2/scanner"
 	"github.com/gaswelder/ring2/server"
+	"github.com/gaswelder/ring2/server/queue"
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
 func readConfig(path string) (*server.Config, error) {
 	cnf := server.Config{
 		Hostname: "localhost",
 		Maildir:  "./mail",
+		MaxSize:  10 * 1024 * 1024,
 		Lists:    make(map[string][]*server.UserRec),
 		Users:    make(map[string]*server.UserRec),
 	}
@@ -26,66 +31,277 @@ func readConfig(path string) (*server.Config, error) {
 	if ok {
 		for key, val := range sec {
 			switch key {
-			case "smtp":
-				cnf.Smtp = val
-			case "pop":
-				cnf.Pop = val
+			case "smtp", "smtps", "submission", "submissions", "pop", "pops":
+				list, err := listeners(key, val)
+				if err != nil {
+					return nil, err
+				}
+				cnf.Listeners = append(cnf.Listeners, list...)
 			case "maildir":
 				cnf.Maildir = val
 			case "hostname":
 				cnf.Hostname = val
+			case "domains":
+				cnf.Domains = strings.FieldsFunc(val, func(c rune) bool {
+					return c == ',' || c == ' ' || c == '\t'
+				})
+			case "tlscert":
+				cnf.TLSCert = val
+			case "tlskey":
+				cnf.TLSKey = val
+			case "maxsize":
+				size, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || size < 0 {
+					return nil, fmt.Errorf("Invalid maxsize: %s", val)
+				}
+				cnf.MaxSize = size
 			case "debug":
 				cnf.Debug = true
+			case "vrfy-anon":
+				cnf.VerifyAnon = true
+			case "check-sender":
+				cnf.CheckSender = true
 			default:
 				return nil, fmt.Errorf("Unknown param %s", key)
 			}
 		}
 	}
 
-	sec, ok = conf["lists"]
+	sec, ok = conf["relay"]
 	if ok {
-		for key, val := range sec {
-			if val != "true" {
-				return nil, fmt.Errorf("Unexpected argument to the maillist '%s': %s", key, val)
-			}
-			cnf.Lists[key] = make([]*server.UserRec, 0)
+		relay, err := parseRelay(sec)
+		if err != nil {
+			return nil, err
 		}
+		cnf.Relay = relay
 	}
 
-	sec, ok = conf["users"]
-	if ok {
-		for key, val := range sec {
-			user, err := parseUserSpec(val)
-			if err != nil {
-				return nil, err
+	err = parseDomain(conf["lists"], conf["users"], cnf.Lists, cnf.Users, "")
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * Sections like "users example.com" and "lists example.com"
+	 * describe virtual domains.
+	 */
+	cnf.Virtual = make(map[string]*server.Domain)
+	lists := make(map[string]map[string]string)
+	users := make(map[string]map[string]string)
+	for key, sec := range conf {
+		pos := strings.Index(key, " ")
+		if pos < 0 {
+			continue
+		}
+		// Domain names are case-insensitive, so "users Example.com"
+		// and "lists example.com" describe the same domain.
+		kind, name := key[:pos], strings.ToLower(key[pos+1:])
+		var secs map[string]map[string]string
+		switch kind {
+		case "users":
+			secs = users
+		case "lists":
+			secs = lists
+		default:
+			return nil, fmt.Errorf("Unexpected section argument: %s", key)
+		}
+		if _, ok := secs[name]; ok {
+			return nil, fmt.Errorf("Duplicate section: %s", key)
+		}
+		secs[name] = sec
+		if _, ok := cnf.Virtual[name]; ok {
+			continue
+		}
+		if strings.EqualFold(name, cnf.Hostname) {
+			return nil, fmt.Errorf("%s is the hostname, its users go to the plain users section", name)
+		}
+		for _, d := range cnf.Domains {
+			if strings.EqualFold(name, d) {
+				return nil, fmt.Errorf("%s is listed in domains and can't have its own users", name)
 			}
-			user.Name = key
-			cnf.Users[key] = user
-			for _, listname := range user.Lists {
-				_, ok := cnf.Lists[listname]
-				if !ok {
-					return nil, fmt.Errorf("Unknown list: %s", listname)
-				}
-				cnf.Lists[listname] = append(cnf.Lists[listname], user)
+		}
+		// Mailboxes of a virtual domain are in a directory named
+		// after it, next to the mailboxes of the main users.
+		for user := range cnf.Users {
+			if strings.EqualFold(name, user) {
+				return nil, fmt.Errorf("%s is both a user and a domain", user)
 			}
 		}
+		cnf.Virtual[name] = &server.Domain{
+			Name:  name,
+			Lists: make(map[string][]*server.UserRec),
+			Users: make(map[string]*server.UserRec),
+		}
+	}
+	for name, d := range cnf.Virtual {
+		err := parseDomain(lists[name], users[name], d.Lists, d.Users, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if (cnf.TLSCert == "") != (cnf.TLSKey == "") {
+		return nil, errors.New("tlscert and tlskey must be specified together")
 	}
 	return &cnf, nil
 }
 
+// parseDomain reads the lists and users sections of a domain.
+func parseDomain(listsSec, usersSec map[string]string, lists map[string][]*server.UserRec, users map[string]*server.UserRec, domain string) error {
+	for key, val := range listsSec {
+		if val != "true" {
+			return fmt.Errorf("Unexpected argument to the maillist '%s': %s", key, val)
+		}
+		lists[key] = make([]*server.UserRec, 0)
+	}
+
+	for key, val := range usersSec {
+		user, err := parseUserSpec(val)
+		if err != nil {
+			return err
+		}
+		user.Name = key
+		user.Domain = domain
+		users[key] = user
+		for _, listname := range user.Lists {
+			_, ok := lists[listname]
+			if !ok {
+				return fmt.Errorf("Unknown list: %s", listname)
+			}
+			lists[listname] = append(lists[listname], user)
+		}
+	}
+	return nil
+}
+
+func parseRelay(sec map[string]string) (*queue.Smarthost, error) {
+	relay := &queue.Smarthost{
+		TLS: queue.TLSStartTLS,
+	}
+	for key, val := range sec {
+		switch key {
+		case "host":
+			relay.Host = val
+		case "port":
+			relay.Port = val
+		case "tls":
+			relay.TLS = val
+		case "user":
+			relay.User = val
+		case "password":
+			relay.Password = val
+		default:
+			return nil, fmt.Errorf("Unknown relay param %s", key)
+		}
+	}
+
+	if relay.Host == "" {
+		return nil, errors.New("relay host is not specified")
+	}
+	switch relay.TLS {
+	case queue.TLSNone:
+		if relay.Port == "" {
+			relay.Port = "25"
+		}
+	case queue.TLSStartTLS:
+		if relay.Port == "" {
+			relay.Port = "587"
+		}
+	case queue.TLSImplicit:
+		if relay.Port == "" {
+			relay.Port = "465"
+		}
+	default:
+		return nil, fmt.Errorf("Unknown relay tls mode: %s", relay.TLS)
+	}
+	if (relay.User == "") != (relay.Password == "") {
+		return nil, errors.New("relay user and password must be specified together")
+	}
+	return relay, nil
+}
+
+// Returns listeners for each address in a list like ":25, localhost:2525".
+// An address may be followed by options that replace the default SMTP
+// policy of the listener kind, like "localhost:2525 auth relay".
+func listeners(kind string, spec string) ([]server.Listener, error) {
+	list := make([]server.Listener, 0)
+	for _, item := range strings.Split(spec, ",") {
+		words := strings.Fields(item)
+		if len(words) == 0 {
+			continue
+		}
+		l := server.Listener{
+			Proto: server.ProtoSMTP,
+			Addr:  words[0],
+		}
+		switch kind {
+		case "smtps":
+			l.TLS = true
+		case "submission":
+			l.RequireAuth = true
+			l.RequireTLS = true
+			l.Relay = true
+		case "submissions":
+			l.TLS = true
+			l.RequireAuth = true
+			l.Relay = true
+		case "pop":
+			l.Proto = server.ProtoPOP
+		case "pops":
+			l.Proto = server.ProtoPOP
+			l.TLS = true
+		}
+
+		options := words[1:]
+		if len(options) > 0 {
+			if l.Proto != server.ProtoSMTP {
+				return nil, fmt.Errorf("%s %s: options are only supported for SMTP", kind, l.Addr)
+			}
+			l.RequireAuth = false
+			l.RequireTLS = false
+			l.Relay = false
+		}
+		for _, opt := range options {
+			switch opt {
+			case "auth":
+				l.RequireAuth = true
+			case "tls":
+				l.RequireTLS = true
+			case "relay":
+				l.Relay = true
+			case "inbound":
+			default:
+				return nil, fmt.Errorf("%s %s: unknown option %s", kind, l.Addr, opt)
+			}
+		}
+		list = append(list, l)
+	}
+	return list, nil
+}
+
 func parseUserSpec(spec string) (*server.UserRec, error) {
 
 	user := new(server.UserRec)
 	b := scanner.New(spec)
 
-	if b.Next() == '$' {
+	if strings.HasPrefix(b.Rest(), sasl.ScramPrefix) {
+		spec := ""
+		for b.More() && !isSpace(b.Next()) {
+			spec += string(b.Get())
+		}
+		scram, err := sasl.ParseScramCredentials(spec)
+		if err != nil {
+			return nil, err
+		}
+		user.Scram = scram
+	} else if b.Next() == '$' {
 		for b.More() && !isSpace(b.Next()) {
 			user.Pwhash += string(b.Get())
 		}
 	} else if b.Next() == '"' {
 		b.Get()
 		for b.More() && b.Next() != '"' {
-			user.Password += string(b.Get())
+			user.Password += string([]byte{b.Get()})
 		}
 		if b.Get() != '"' {
 			return nil, errors.New("Unmatched password quote")
@@ -100,9 +316,42 @@ func parseUserSpec(spec string) (*server.UserRec, error) {
 	for _, name := range lists {
 		user.Lists = append(user.Lists, name)
 	}
+
+	user.Senders, err = parseSenders(b)
+	if err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
+// parseSenders reads a list of addresses like "<joe.smith@pi, boss>".
+func parseSenders(b *scanner.Scanner) ([]string, error) {
+	senders := make([]string, 0)
+	skipSpace(b)
+	if b.Next() != '<' {
+		return senders, nil
+	}
+	b.Get()
+
+	for {
+		addr := ""
+		for b.More() && b.Next() != ',' && b.Next() != '>' {
+			addr += string([]byte{b.Get()})
+		}
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			return senders, errors.New("Empty sender address before " + b.Rest())
+		}
+		senders = append(senders, addr)
+		if !b.More() {
+			return senders, errors.New("'>' expected")
+		}
+		if b.Get() == '>' {
+			return senders, nil
+		}
+	}
+}
+
 func parseLists(b *scanner.Scanner) ([]string, error) {
 	lists := make([]string, 0)
 	skipSpace(b)
@@ -125,7 +374,7 @@ func parseLists(b *scanner.Scanner) ([]string, error) {
 		}
 	}
 
-	if b.Next() != ']' {
+	if b.Get() != ']' {
 		return lists, errors.New("']' expected")
 	}
 	return lists, nil
@@ -1,3 +1,5 @@
 module github.com/gaswelder/ring2
 
+go 1.16
+
 require golang.org/x/crypto v0.0.0-20200403201458-baeed622b8d8
@@ -1,17 +1,50 @@
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/gaswelder/ring2/server"
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
 func main() {
+	scram := flag.Bool("scram", false, "read a password from the standard input and print its SCRAM-SHA-256 credentials")
+	flag.Parse()
+	if *scram {
+		err := printScram()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	config, err := readConfig("conf")
 	if err != nil {
 		log.Fatal(err)
 	}
 	s := server.New(config)
-	s.Run()
+	err = s.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
 	select {}
 }
+
+// printScram prints the credentials to be put into the users section.
+func printScram() error {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	creds, err := sasl.NewScramCredentials(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(creds.String())
+	return nil
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"io/ioutil"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"testing"
+
+	"github.com/gaswelder/ring2/server"
 )
 
 func TestMain(t *testing.T) {
-	var err error
+	config, err := readConfig("conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Maildir = t.TempDir()
+	s := server.New(config)
+	err = s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
 
 	addr := "localhost:2525"
 	msg := "From: nobody\r\nSubject: whatever\r\n\r\nHey you!"
@@ -26,3 +41,123 @@ func TestMain(t *testing.T) {
 		}
 	})
 }
+
+func TestVirtualDomains(t *testing.T) {
+	dir := t.TempDir()
+	conf := dir + "/conf"
+	err := ioutil.WriteFile(conf, []byte(`server {
+	smtp localhost:2526
+	pop localhost:11001
+	hostname localhost
+}
+users {
+	joe "123"
+}
+lists example.com {
+	staff
+}
+users example.com {
+	joe "456" [staff]
+}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Maildir = dir + "/mail"
+	s := server.New(config)
+	err = s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	msg := "From: nobody\r\nSubject: whatever\r\n\r\nHey you!"
+	err = smtp.SendMail("localhost:2526", nil, "nobody@localhost", []string{"staff@Example.com"}, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = smtp.SendMail("localhost:2526", nil, "nobody@localhost", []string{"joe@example.org"}, []byte(msg))
+	if err == nil {
+		t.Error("mail for an unknown domain is accepted")
+	}
+
+	conn, err := textproto.Dial("tcp", "localhost:11001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expect := func(prefix string) {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Fatalf("expected %q, got %q", prefix, line)
+		}
+	}
+	expect("+OK")
+	conn.PrintfLine("USER joe@example.com")
+	expect("+OK")
+	conn.PrintfLine("PASS 123")
+	expect("-ERR")
+	conn.PrintfLine("USER joe@example.com")
+	expect("+OK")
+	conn.PrintfLine("PASS 456")
+	expect("+OK")
+	conn.PrintfLine("STAT")
+	expect("+OK 1 ")
+	conn.PrintfLine("QUIT")
+	expect("+OK")
+
+	list, err := ioutil.ReadDir(config.Maildir + "/example.com/joe")
+	if err != nil || len(list) == 0 {
+		t.Errorf("the message is not in the domain's mailbox: %v", err)
+	}
+}
+
+// parseConfig reads the configuration from the given text.
+func parseConfig(t *testing.T, text string) (*server.Config, error) {
+	path := t.TempDir() + "/conf"
+	err := ioutil.WriteFile(path, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readConfig(path)
+}
+
+func TestMixedCaseDomain(t *testing.T) {
+	config, err := parseConfig(t, `lists Example.com {
+	staff
+}
+users EXAMPLE.com {
+	joe "456" [staff]
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := config.Virtual["example.com"]
+	if d == nil {
+		t.Fatal("the domain is not defined")
+	}
+	if d.Users["joe"] == nil || len(d.Lists["staff"]) != 1 {
+		t.Errorf("the domain's users are lost: %v, %v", d.Users, d.Lists)
+	}
+}
+
+func TestUserNamedAsDomain(t *testing.T) {
+	_, err := parseConfig(t, `users {
+	example.org "123"
+}
+users example.org {
+	joe "456"
+}
+`)
+	if err == nil {
+		t.Error("a user with the name of a domain is accepted")
+	}
+}
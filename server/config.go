@@ -1,7 +1,14 @@
 package server
 
 import (
+	"crypto/subtle"
+	"strings"
+
 	"github.com/gaswelder/ring2/server/mailbox"
+	"github.com/gaswelder/ring2/server/pop"
+	"github.com/gaswelder/ring2/server/queue"
+	"github.com/gaswelder/ring2/server/sasl"
+	"github.com/gaswelder/ring2/server/smtp"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -12,48 +19,263 @@ type UserRec struct {
 	Name     string
 	Pwhash   string
 	Password string
-	Lists    []string
+	// SCRAM-SHA-256 keys, which also serve to check
+	// plaintext passwords.
+	Scram *sasl.ScramCredentials
+	Lists []string
+	// Addresses the user may send mail from besides the
+	// user's own. Addresses without a domain are in the
+	// user's domain.
+	Senders []string
+	// Virtual domain the user belongs to, empty for users
+	// of the main domain.
+	Domain string
+}
+
+// Login returns the name the user logs in with: the user's
+// name in the main domain and "name@domain" in virtual ones.
+func (u *UserRec) Login() string {
+	if u.Domain == "" {
+		return u.Name
+	}
+	return u.Name + "@" + u.Domain
+}
+
+// Domain is a mail domain with its own users and lists.
+type Domain struct {
+	Name  string
+	Lists map[string][]*UserRec
+	Users map[string]*UserRec
 }
 
 // Config is a structure to keep user-provided
 // server parameters.
 type Config struct {
-	Debug    bool
-	Hostname string
-	Maildir  string
-	Smtp     string
-	Pop      string
-	Lists    map[string][]*UserRec
-	Users    map[string]*UserRec
+	Debug     bool
+	Hostname  string
+	Maildir   string
+	TLSCert   string
+	TLSKey    string
+	Listeners []Listener
+	MaxSize   int64
+	Lists     map[string][]*UserRec
+	Users     map[string]*UserRec
+
+	// Other domains whose mail is delivered to the users
+	// and lists above.
+	Domains []string
+	// Virtual domains by lowercase name, each with
+	// its own users and lists.
+	Virtual map[string]*Domain
+	// If set, outgoing mail is forwarded through this server.
+	Relay *queue.Smarthost
+	// If set, VRFY and EXPN are available to unauthenticated
+	// SMTP clients.
+	VerifyAnon bool
+	// If set, authenticated users may send mail only from
+	// their own addresses.
+	CheckSender bool
 }
 
-// Returns user record with given name and password.
+// Returns user record with given login and password.
 // Returns nil if there is no such user.
-func (c *Config) findUser(name, pass string) *UserRec {
-	for _, user := range c.Users {
-		if user.Name != name {
-			continue
+func (c *Config) findUser(login, pass string) *UserRec {
+	user := c.user(login)
+	if user == nil {
+		return nil
+	}
+
+	if user.Password != "" {
+		if user.Password == pass {
+			return user
 		}
+		return nil
+	}
 
-		if user.Password != "" {
-			if user.Password == pass {
-				return user
-			}
-			return nil
+	if user.Pwhash != "" {
+		err := bcrypt.CompareHashAndPassword([]byte(user.Pwhash), []byte(pass))
+		if err == nil {
+			return user
 		}
+		return nil
+	}
 
-		if user.Pwhash != "" {
-			err := bcrypt.CompareHashAndPassword([]byte(user.Pwhash), []byte(pass))
-			if err == nil {
-				return user
-			}
-			return nil
+	if user.Scram != nil {
+		if user.Scram.Check(pass) {
+			return user
 		}
+		return nil
+	}
+	return nil
+}
+
+// user returns the user with the given login, nil if there is no
+// such user. Users of the main domain may log in with their names
+// or full addresses, users of virtual domains with full addresses.
+func (c *Config) user(login string) *UserRec {
+	d := c.domain(c.Hostname)
+	name := login
+	pos := strings.LastIndex(login, "@")
+	if pos >= 0 {
+		d = c.domain(login[pos+1:])
+		name = login[:pos]
+	}
+	if d == nil {
+		return nil
+	}
+	return d.Users[name]
+}
+
+// backend checks credentials of SMTP and POP clients
+// against the configured users.
+type backend struct {
+	config *Config
+}
+
+func (b *backend) Verify(name, password string) error {
+	if b.config.findUser(name, password) == nil {
+		return sasl.ErrInvalid
+	}
+	return nil
+}
+
+func (b *backend) Secret(name string) (string, error) {
+	user := b.config.user(name)
+	if user == nil || user.Password == "" {
+		return "", sasl.ErrNoSecret
+	}
+	return user.Password, nil
+}
+
+func (b *backend) VerifyDigest(name, timestamp, digest string) error {
+	password, err := b.Secret(name)
+	if err != nil {
+		return sasl.ErrInvalid
+	}
+	expected := pop.Digest(timestamp, password)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(digest))) != 1 {
+		return sasl.ErrInvalid
 	}
 	return nil
 }
 
+func (b *backend) Hostname() string {
+	return b.config.Hostname
+}
+
+func (b *backend) ScramCredentials(name string) (*sasl.ScramCredentials, error) {
+	user := b.config.user(name)
+	if user == nil || user.Scram == nil {
+		return nil, sasl.ErrNoSecret
+	}
+	return user.Scram, nil
+}
+
 func (c *Config) mailbox(u *UserRec) (*mailbox.Mailbox, error) {
 	path := c.Maildir + "/" + u.Name
+	if u.Domain != "" {
+		path = c.Maildir + "/" + u.Domain + "/" + u.Name
+	}
 	return mailbox.New(path)
 }
+
+// tempDir returns the directory for messages that are
+// being received.
+func (c *Config) tempDir() string {
+	return c.Maildir + "/.tmp"
+}
+
+// domain returns the local domain with the given name,
+// nil if mail for the domain is not delivered here.
+func (c *Config) domain(host string) *Domain {
+	main := &Domain{Name: c.Hostname, Lists: c.Lists, Users: c.Users}
+	if strings.EqualFold(host, c.Hostname) {
+		return main
+	}
+	for _, d := range c.Domains {
+		if strings.EqualFold(host, d) {
+			return main
+		}
+	}
+	return c.Virtual[strings.ToLower(host)]
+}
+
+// isLocal returns true if mail for the given domain is delivered here.
+func (c *Config) isLocal(host string) bool {
+	return c.domain(host) != nil
+}
+
+// localDomains returns names of the local domains
+// besides the hostname.
+func (c *Config) localDomains() []string {
+	list := append([]string{}, c.Domains...)
+	for name := range c.Virtual {
+		list = append(list, name)
+	}
+	return list
+}
+
+// userDomain returns the domain the user belongs to.
+func (c *Config) userDomain(u *UserRec) *Domain {
+	if u.Domain == "" {
+		return c.domain(c.Hostname)
+	}
+	return c.Virtual[u.Domain]
+}
+
+// isSender returns true if the user may send mail
+// from the given address.
+func (c *Config) isSender(u *UserRec, name, host string) bool {
+	own := c.userDomain(u)
+	d := c.domain(host)
+	if name == u.Name && d != nil && d.Name == own.Name {
+		return true
+	}
+	for _, addr := range u.Senders {
+		pos := strings.LastIndex(addr, "@")
+		if pos < 0 {
+			if name == addr && d != nil && d.Name == own.Name {
+				return true
+			}
+			continue
+		}
+		if name == addr[:pos] && strings.EqualFold(host, addr[pos+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// boxes returns mailboxes of a user or of all members of a list
+// in a local domain.
+func (c *Config) boxes(name, host string) ([]*mailbox.Mailbox, error) {
+	boxes := make([]*mailbox.Mailbox, 0)
+	d := c.domain(host)
+	if d == nil {
+		return nil, smtp.ErrUnknownRecipient
+	}
+
+	list, _ := d.Lists[name]
+	if list != nil {
+		for _, user := range list {
+			box, err := c.mailbox(user)
+			if err != nil {
+				return nil, err
+			}
+			boxes = append(boxes, box)
+		}
+		return boxes, nil
+	}
+
+	user, ok := d.Users[name]
+	if ok {
+		box, err := c.mailbox(user)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+		return boxes, nil
+
+	}
+	return nil, smtp.ErrUnknownRecipient
+}
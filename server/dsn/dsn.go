@@ -0,0 +1,209 @@
+// Package dsn composes delivery status notifications (RFC 3464).
+package dsn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Actions reported for recipients.
+const (
+	Failed    = "failed"
+	Delayed   = "delayed"
+	Delivered = "delivered"
+	Relayed   = "relayed"
+	Expanded  = "expanded"
+)
+
+// Report describes what happened to a message.
+type Report struct {
+	// ReportingMTA is the name of the host making the report.
+	ReportingMTA string
+	// To is the address the report is sent to, which is the
+	// reverse-path of the original message.
+	To string
+	// Arrival is the time the original message was received.
+	Arrival    time.Time
+	Recipients []*Recipient
+	// Original is the text of the message the report is about.
+	Original io.Reader
+	// If set, only the headers of the original are returned.
+	HeadersOnly bool
+	// EnvID is the envelope identifier given by the sender.
+	EnvID string
+}
+
+// Recipient is the delivery status for one recipient.
+type Recipient struct {
+	// Original is the recipient's address as given by the sender
+	// in the ORCPT parameter, like "rfc822;bob@example.net".
+	Original string
+	// Final is the recipient's address.
+	Final string
+	// Action is one of the actions above.
+	Action string
+	// Status is the status code like "5.1.1" (RFC 3463).
+	Status string
+	// Reason is a human-readable explanation of the status.
+	Reason string
+	// Diagnostic is the reply of the remote server, if the
+	// status was reported by one, like "550 No such user".
+	Diagnostic string
+}
+
+// Reader returns the text of the report message. The original
+// message is read as the returned reader is.
+func (r *Report) Reader() io.Reader {
+	boundary := newBoundary()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", r.ReportingMTA)
+	fmt.Fprintf(&b, "To: <%s>\r\n", r.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", r.subject())
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\r\n")
+	fmt.Fprintf(&b, "\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "This is a MIME-encapsulated message.\r\n")
+
+	// Human-readable part
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "This is the mail system at %s.\r\n\r\n", r.ReportingMTA)
+	for _, action := range []string{Failed, Delayed, Delivered, Relayed, Expanded} {
+		r.describe(&b, action)
+	}
+
+	// Machine-readable part
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\r\n\r\n")
+	if r.EnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", r.EnvID)
+	}
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if !r.Arrival.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\r\n", r.Arrival.Format(time.RFC1123Z))
+	}
+	fmt.Fprintf(&b, "\r\n")
+	for _, rcpt := range r.Recipients {
+		if rcpt.Original != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s\r\n", rcpt.Original)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", rcpt.Final)
+		fmt.Fprintf(&b, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", rcpt.Status)
+		if rcpt.Diagnostic != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", rcpt.Diagnostic)
+		}
+		fmt.Fprintf(&b, "\r\n")
+	}
+
+	// The original message or its headers
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	original := r.Original
+	if r.HeadersOnly {
+		fmt.Fprintf(&b, "Content-Type: text/rfc822-headers\r\n\r\n")
+		original = &headerReader{r: bufio.NewReader(r.Original)}
+	} else {
+		fmt.Fprintf(&b, "Content-Type: message/rfc822\r\n\r\n")
+	}
+	footer := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	return io.MultiReader(strings.NewReader(b.String()), original, strings.NewReader(footer))
+}
+
+func (r *Report) subject() string {
+	failed, delivered := 0, 0
+	for _, rcpt := range r.Recipients {
+		switch rcpt.Action {
+		case Failed:
+			failed++
+		case Delivered, Relayed, Expanded:
+			delivered++
+		}
+	}
+	switch {
+	case failed == len(r.Recipients):
+		return "Undelivered Mail Returned to Sender"
+	case delivered == len(r.Recipients):
+		return "Successful Mail Delivery Report"
+	}
+	return "Delivery Status Notification"
+}
+
+var descriptions = map[string]string{
+	Failed:    "Your message could not be delivered to the following recipients:",
+	Delayed:   "Delivery of your message to the following recipients has been delayed:",
+	Delivered: "Your message has been delivered to the following recipients:",
+	Relayed:   "Your message has been relayed to the following recipients, no further notifications will be sent:",
+	Expanded:  "Your message has been delivered to the following mailing lists:",
+}
+
+// Writes the human-readable list of recipients with the given action.
+func (r *Report) describe(b *strings.Builder, action string) {
+	n := 0
+	for _, rcpt := range r.Recipients {
+		if rcpt.Action != action {
+			continue
+		}
+		if n == 0 {
+			fmt.Fprintf(b, "%s\r\n\r\n", descriptions[action])
+		}
+		n++
+		if rcpt.Reason != "" {
+			fmt.Fprintf(b, "<%s>: %s\r\n", rcpt.Final, rcpt.Reason)
+		} else {
+			fmt.Fprintf(b, "<%s>\r\n", rcpt.Final)
+		}
+	}
+	if n > 0 {
+		fmt.Fprintf(b, "\r\n")
+	}
+}
+
+// headerReader reads the header section of a message,
+// without the empty line that ends it.
+type headerReader struct {
+	r    *bufio.Reader
+	line []byte
+	// Set when the last read stopped in the middle of a line.
+	partial bool
+	done    bool
+}
+
+func (h *headerReader) Read(p []byte) (int, error) {
+	for len(h.line) == 0 {
+		if h.done {
+			return 0, io.EOF
+		}
+		line, err := h.r.ReadSlice('\n')
+		if err == io.EOF {
+			h.done = true
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return 0, err
+		}
+		if !h.partial && string(line) == "\r\n" {
+			h.done = true
+			continue
+		}
+		h.partial = err == bufio.ErrBufferFull
+		h.line = line
+	}
+	n := copy(p, h.line)
+	h.line = h.line[n:]
+	return n, nil
+}
+
+func newBoundary() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", b)
+}
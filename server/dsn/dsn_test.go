@@ -0,0 +1,97 @@
+package dsn
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	original := "Subject: hello\r\n\r\nHey you!\r\n"
+	r := &Report{
+		ReportingMTA: "pi.example.net",
+		To:           "joe@example.net",
+		Recipients: []*Recipient{
+			{
+				Final:      "bob@example.org",
+				Action:     Failed,
+				Status:     "5.1.1",
+				Reason:     "550 5.1.1 No such user",
+				Diagnostic: "550 5.1.1 No such user",
+			},
+		},
+		Original: strings.NewReader(original),
+	}
+
+	msg, err := mail.ReadMessage(r.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "<joe@example.net>" {
+		t.Errorf("unexpected To: %s", msg.Header.Get("To"))
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected content type: %s %v", mediaType, params)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	types := []string{"text/plain", "message/delivery-status", "message/rfc822"}
+	bodies := make([]string, 0)
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if i >= len(types) {
+			t.Fatal("too many parts")
+		}
+		ct, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if ct != types[i] {
+			t.Errorf("part %d: expected %s, got %s", i, types[i], ct)
+		}
+		body, _ := ioutil.ReadAll(part)
+		bodies = append(bodies, string(body))
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(bodies))
+	}
+
+	// The status part is a message-level group and a group per
+	// recipient, all in header syntax.
+	tr := textproto.NewReader(bufio.NewReader(strings.NewReader(bodies[1])))
+	group, err := tr.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Get("Reporting-MTA") != "dns; pi.example.net" {
+		t.Errorf("unexpected Reporting-MTA: %s", group.Get("Reporting-MTA"))
+	}
+	group, err = tr.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"Final-Recipient": "rfc822; bob@example.org",
+		"Action":          "failed",
+		"Status":          "5.1.1",
+		"Diagnostic-Code": "smtp; 550 5.1.1 No such user",
+	}
+	for k, v := range expected {
+		if group.Get(k) != v {
+			t.Errorf("%s: expected %q, got %q", k, v, group.Get(k))
+		}
+	}
+
+	if bodies[2] != original {
+		t.Errorf("expected the original message, got %q", bodies[2])
+	}
+}
@@ -0,0 +1,100 @@
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NOTIFY parameter values (RFC 3461, 4.1).
+const (
+	Never   = "NEVER"
+	Success = "SUCCESS"
+	Failure = "FAILURE"
+	Delay   = "DELAY"
+)
+
+// RET parameter values (RFC 3461, 4.3).
+const (
+	RetFull = "FULL"
+	RetHdrs = "HDRS"
+)
+
+// Requested returns true if the NOTIFY values ask for
+// a notification about the given action. Without a NOTIFY
+// parameter only failures are reported.
+func Requested(notify []string, action string) bool {
+	if len(notify) == 0 {
+		return action == Failed
+	}
+	for _, n := range notify {
+		switch {
+		case n == Success && (action == Delivered || action == Relayed || action == Expanded):
+			return true
+		case n == Failure && action == Failed:
+			return true
+		case n == Delay && action == Delayed:
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNotify parses the value of the NOTIFY parameter.
+func ParseNotify(val string) ([]string, error) {
+	list := strings.Split(strings.ToUpper(val), ",")
+	for _, n := range list {
+		switch n {
+		case Never:
+			if len(list) > 1 {
+				return nil, errors.New("NEVER can't be combined with other values")
+			}
+		case Success, Failure, Delay:
+		default:
+			return nil, fmt.Errorf("invalid NOTIFY value: %s", n)
+		}
+	}
+	return list, nil
+}
+
+// DecodeXtext decodes a string in the "xtext" encoding used by
+// DSN parameters, where "+" followed by two hex digits encodes
+// a character (RFC 3461, 4).
+func DecodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '+' {
+			if i+2 >= len(s) {
+				return "", errors.New("truncated xtext")
+			}
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid xtext: %s", s)
+			}
+			b.WriteByte(byte(n))
+			i += 2
+			continue
+		}
+		if c < '!' || c > '~' || c == '=' {
+			return "", fmt.Errorf("invalid xtext: %s", s)
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// EncodeXtext encodes a string to xtext.
+func EncodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
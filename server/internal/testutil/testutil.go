@@ -0,0 +1,73 @@
+// Package testutil has helpers shared by tests of the SMTP
+// and POP servers.
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaswelder/ring2/server/sasl"
+)
+
+// Recorder is a connection that reads a prepared script
+// and records every write separately.
+type Recorder struct {
+	io.Reader
+	Writes []string
+}
+
+func (c *Recorder) Write(p []byte) (int, error) {
+	c.Writes = append(c.Writes, string(p))
+	return len(p), nil
+}
+
+// String returns everything written.
+func (c *Recorder) String() string {
+	return strings.Join(c.Writes, "")
+}
+
+// Users is an authentication backend that maps
+// user names to passwords.
+type Users map[string]string
+
+func (u Users) Verify(name, password string) error {
+	if p, ok := u[name]; !ok || p != password {
+		return sasl.ErrInvalid
+	}
+	return nil
+}
+
+func (u Users) Secret(name string) (string, error) {
+	p, ok := u[name]
+	if !ok {
+		return "", sasl.ErrNoSecret
+	}
+	return p, nil
+}
+
+// Cert returns a self-signed certificate for localhost.
+func Cert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
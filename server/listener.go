@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// Protocols served by listeners.
+const (
+	ProtoSMTP = "smtp"
+	ProtoPOP  = "pop"
+)
+
+// Listener describes an address the server accepts
+// connections on.
+type Listener struct {
+	Proto string
+	Addr  string
+	// If set, connections are TLS from the first byte.
+	TLS bool
+
+	// Policy of SMTP listeners. By default, mail is accepted from
+	// anyone, but only for local recipients.
+
+	// If set, clients must authenticate before sending mail.
+	RequireAuth bool
+	// If set, clients must switch to TLS before authenticating
+	// or sending mail.
+	RequireTLS bool
+	// If set, authenticated clients may send mail to remote
+	// recipients.
+	Relay bool
+}
+
+// Name returns the listener's name for logging purposes,
+// like "SMTP" or "POPS".
+func (l Listener) Name() string {
+	name := strings.ToUpper(l.Proto)
+	if l.TLS {
+		name += "S"
+	}
+	return name
+}
+
+// handler runs a protocol session over an accepted connection.
+type handler func(c *session)
+
+func (s *Server) listen(l Listener) (net.Listener, error) {
+	if l.TLS && s.tls == nil {
+		return nil, fmt.Errorf("%s on %s: TLS certificate is not configured", l.Name(), l.Addr)
+	}
+	if l.RequireTLS && s.tls == nil {
+		return nil, fmt.Errorf("%s on %s: TLS is required, but the certificate is not configured", l.Name(), l.Addr)
+	}
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if l.TLS {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	return ln, nil
+}
+
+func (s *Server) handler(l Listener) handler {
+	switch l.Proto {
+	case ProtoSMTP:
+		return smtpHandler(s.config, s.tls, s.queue, l)
+	case ProtoPOP:
+		return popHandler(s.config, s.tls, l)
+	}
+	panic("unknown protocol: " + l.Proto)
+}
+
+// serve accepts connections from the listener until it's closed.
+func serve(ln net.Listener, debug bool, handle handler) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("%s connected\n", conn.RemoteAddr().String())
+		c := &session{conn, debug}
+		go func() {
+			handle(c)
+			c.Close()
+			log.Printf("%s disconnected\n", c.RemoteAddr().String())
+		}()
+	}
+}
@@ -2,12 +2,18 @@ package mailbox
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -51,6 +57,13 @@ func (b *Mailbox) List() ([]*Message, error) {
 		return make([]*Message, 0), nil
 	}
 
+	uidMu.Lock()
+	_, err = b.loadUIDs()
+	uidMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
 	/*
 	 * Read and sort all directory entries
 	 */
@@ -81,6 +94,7 @@ func (b *Mailbox) List() ([]*Message, error) {
 		m.size = info.Size()
 		m.filename = info.Name()
 		m.path = b.path + "/" + m.filename
+		m.uid = parseUID(m.filename)
 		messages = append(messages, m)
 	}
 	return messages, nil
@@ -109,6 +123,7 @@ func (b *Mailbox) LastRetrievedMessage() (*Message, error) {
 	m.size = stat.Size()
 	m.filename = lastName
 	m.path = b.path + "/" + lastName
+	m.uid = parseUID(lastName)
 	return m, nil
 }
 
@@ -124,11 +139,251 @@ func (b *Mailbox) Remove(msg *Message) error {
 	return os.Remove(b.path + "/" + msg.filename)
 }
 
-// Add creates a new message from the given text and saves it to the mailbox.
-func (b *Mailbox) Add(text string) error {
-	name := time.Now().Format("20060102-150405-") + fmt.Sprintf("%x", md5.Sum([]byte(text)))
+// Add reads a new message from the given reader and saves it to the
+// mailbox. The text is written to a temporary file first, so the
+// message appears in the mailbox only when it's complete.
+func (b *Mailbox) Add(text io.Reader) error {
+	err := createDir(b.path)
+	if err != nil {
+		return err
+	}
+
+	// Temporary files start with a dot, so List doesn't see them.
+	f, err := ioutil.TempFile(b.path, ".new-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), text)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	/*
+	 * The counter is saved before the message appears,
+	 * so that the UID is not given out again even if
+	 * the process stops right here.
+	 */
+	uidMu.Lock()
+	defer uidMu.Unlock()
+	uid, err := b.loadUIDs()
+	if err == nil {
+		err = b.writeFile(uidNextFile, strconv.Itoa(uid+1))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	name := formatUID(uid) + time.Now().Format("-20060102-150405-") + fmt.Sprintf("%x", hash.Sum(nil))
 	log.Printf("Saving message %s", name)
-	return b.writeFile(name, text)
+	err = os.Rename(tmp, b.path+"/"+name)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+/*
+ * Every message has a UID, which is unique in the mailbox and never
+ * given to another message, even after the message is deleted. UIDs
+ * are kept in the file names, like "0000000042-20060102-150405-<md5>",
+ * zero-padded so that the names sort in the order of arrival. The
+ * next UID to give out is kept in the ".uidnext" file.
+ */
+
+const uidNextFile = ".uidnext"
+const uidWidth = 10
+
+// Guards the UID counters.
+var uidMu sync.Mutex
+
+func formatUID(uid int) string {
+	return fmt.Sprintf("%0*d", uidWidth, uid)
+}
+
+// parseUID returns the UID from a message's file name,
+// 0 if the name doesn't have one.
+func parseUID(name string) int {
+	if len(name) <= uidWidth || name[uidWidth] != '-' {
+		return 0
+	}
+	uid, err := strconv.Atoi(name[:uidWidth])
+	if err != nil || uid <= 0 {
+		return 0
+	}
+	return uid
+}
+
+// loadUIDs returns the next UID of the mailbox. Mailboxes from the
+// times before UIDs don't have the counter; their messages get UIDs
+// in the order of arrival. Must be called with uidMu locked.
+func (b *Mailbox) loadUIDs() (int, error) {
+	data, err := b.readFile(uidNextFile)
+	if err == nil {
+		next, err := strconv.Atoi(strings.TrimSpace(data))
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid UID counter: %s", b.path, err.Error())
+		}
+		return next, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(b.path)
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	/*
+	 * The migration may have been interrupted,
+	 * so some messages may have UIDs already.
+	 */
+	next := 1
+	for _, info := range files {
+		if uid := parseUID(info.Name()); uid >= next {
+			next = uid + 1
+		}
+	}
+	last, _ := b.readFile("last")
+	for _, info := range files {
+		name := info.Name()
+		if name[0] == '.' || name == "last" || parseUID(name) > 0 {
+			continue
+		}
+		newName := formatUID(next) + "-" + name
+		log.Printf("Renaming message %s to %s", name, newName)
+		err := os.Rename(b.path+"/"+name, b.path+"/"+newName)
+		if err != nil {
+			return 0, err
+		}
+		if name == last {
+			err = b.writeFile("last", newName)
+			if err != nil {
+				return 0, err
+			}
+		}
+		next++
+	}
+	return next, b.writeFile(uidNextFile, strconv.Itoa(next))
+}
+
+// ErrLocked is returned by Lock if the mailbox
+// is used by another session.
+var ErrLocked = errors.New("mailbox is locked")
+
+// Mailboxes locked by this process. A lock file with this
+// process's pid is stale if the mailbox is not here: it was
+// left by a crashed process that had the same pid.
+var locks = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// Lock gives the caller exclusive access to the mailbox
+// until Unlock is called (RFC 1939 maildrop lock). The lock
+// is a file with the owner's pid, so that locks left by
+// processes that have crashed are detected and dropped.
+func (b *Mailbox) Lock() error {
+	err := createDir(b.path)
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(b.path)
+	if err != nil {
+		return err
+	}
+
+	locks.Lock()
+	defer locks.Unlock()
+	if locks.paths[path] {
+		return ErrLocked
+	}
+
+	for {
+		f, err := os.OpenFile(b.lockPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(b.lockPath())
+				return err
+			}
+			locks.paths[path] = true
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if !b.staleLock() {
+			return ErrLocked
+		}
+		log.Printf("Removing stale lock of %s", b.path)
+		err = os.Remove(b.lockPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// Unlock releases the lock taken by Lock.
+func (b *Mailbox) Unlock() error {
+	path, err := filepath.Abs(b.path)
+	if err != nil {
+		return err
+	}
+	locks.Lock()
+	defer locks.Unlock()
+	delete(locks.paths, path)
+	return os.Remove(b.lockPath())
+}
+
+func (b *Mailbox) lockPath() string {
+	return b.path + "/.lock"
+}
+
+// staleLock returns true if the lock file belongs to a process
+// that doesn't exist anymore. It's called when this process
+// doesn't hold the lock.
+func (b *Mailbox) staleLock() bool {
+	data, err := b.readFile(".lock")
+	if os.IsNotExist(err) {
+		// Removed in the meantime.
+		return true
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(data))
+	if err != nil {
+		// The owner may be writing the file right now, or it
+		// may have crashed in the middle of writing it.
+		stat, err := os.Stat(b.lockPath())
+		return err == nil && time.Since(stat.ModTime()) > time.Minute
+	}
+	return pid == os.Getpid() || !alive(pid)
+}
+
+// alive returns true if a process with the given pid exists.
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
 }
 
 // Returns contents of a file in the directory
@@ -141,14 +396,28 @@ func (b *Mailbox) readFile(name string) (string, error) {
 	return string(val), nil
 }
 
-// Writes data to a file in the directory
+// Writes data to a file in the directory. The file is replaced
+// at once, so it's never seen half-written.
 func (b *Mailbox) writeFile(name string, data string) error {
 	err := createDir(b.path)
 	if err != nil {
 		return err
 	}
-	path := b.path + "/" + name
-	return ioutil.WriteFile(path, []byte(data), 0600)
+	f, err := ioutil.TempFile(b.path, ".new-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(data))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.path+"/"+name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
 
 func createDir(path string) error {
@@ -0,0 +1,131 @@
+package mailbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := New(dir)
+	b, _ := New(dir)
+
+	if err := a.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if err := a.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(); err != nil {
+		t.Errorf("expected the lock to be free, got %v", err)
+	}
+	b.Unlock()
+}
+
+func TestStaleLock(t *testing.T) {
+	// A process that has exited.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+
+	// Locks left by crashed processes, including one that
+	// had the same pid as this process.
+	for _, pid := range []int{cmd.Process.Pid, os.Getpid()} {
+		dir := t.TempDir()
+		err := ioutil.WriteFile(dir+"/.lock", []byte(fmt.Sprintf("%d\n", pid)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		box, _ := New(dir)
+		if err := box.Lock(); err != nil {
+			t.Errorf("pid %d: %v", pid, err)
+		}
+		box.Unlock()
+	}
+
+	// A lock of a live process.
+	dir := t.TempDir()
+	err := ioutil.WriteFile(dir+"/.lock", []byte(fmt.Sprintf("%d\n", os.Getppid())), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, _ := New(dir)
+	if err := box.Lock(); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+}
+
+func TestUIDs(t *testing.T) {
+	box, _ := New(t.TempDir())
+	for i := 0; i < 3; i++ {
+		// Identical messages are kept apart.
+		err := box.Add(strings.NewReader("Subject: hi\r\n\r\nHello\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := box.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(list))
+	}
+	for i, m := range list {
+		if m.UID() != i+1 {
+			t.Errorf("expected UID %d, got %d", i+1, m.UID())
+		}
+	}
+
+	// UIDs of deleted messages are not reused.
+	box.Remove(list[2])
+	box.Add(strings.NewReader("Subject: hi\r\n\r\nHello\r\n"))
+	list, _ = box.List()
+	if len(list) != 3 || list[2].UID() != 4 {
+		t.Errorf("unexpected messages: %v", list)
+	}
+}
+
+func TestUIDMigration(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"20200101-100000-aaaa", "20200101-100000-bbbb", "20200102-100000-aaaa"}
+	for _, name := range names {
+		err := ioutil.WriteFile(dir+"/"+name, []byte("Subject: hi\r\n\r\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(dir+"/last", []byte(names[1]), 0600)
+
+	box, _ := New(dir)
+	list, err := box.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(list))
+	}
+	for i, m := range list {
+		if m.UID() != i+1 || !strings.HasSuffix(m.Filename(), names[i]) {
+			t.Errorf("unexpected message %d: %s", m.UID(), m.Filename())
+		}
+	}
+	last, err := box.LastRetrievedMessage()
+	if err != nil || last == nil || last.UID() != 2 {
+		t.Errorf("the last message is lost: %v, %v", last, err)
+	}
+
+	box.Add(strings.NewReader("Subject: hi\r\n\r\n"))
+	list, _ = box.List()
+	if len(list) != 4 || list[3].UID() != 4 {
+		t.Errorf("unexpected messages after the migration: %v", list)
+	}
+}
@@ -1,21 +1,21 @@
 package mailbox
 
-import "io/ioutil"
+import (
+	"io"
+	"os"
+)
 
 // Message represents a message saved in the mailbox.
 type Message struct {
 	size     int64
 	path     string
 	filename string
+	uid      int
 }
 
-// Content returns contents of the message.
-func (m *Message) Content() (string, error) {
-	v, err := ioutil.ReadFile(m.path)
-	if err != nil {
-		return "", err
-	}
-	return string(v), nil
+// Open returns a reader of the message's text.
+func (m *Message) Open() (io.ReadCloser, error) {
+	return os.Open(m.path)
 }
 
 // Size returns size of the message in bytes.
@@ -23,6 +23,12 @@ func (m *Message) Size() int64 {
 	return m.size
 }
 
+// UID returns the message's identifier, which is unique in the
+// mailbox and is never reused.
+func (m *Message) UID() int {
+	return m.uid
+}
+
 // Filename returns local filename of the message.
 func (m *Message) Filename() string {
 	return m.filename
@@ -33,7 +33,9 @@ func parseCommand(line string) (*command, error) {
 	if r.Next() == ' ' {
 		r.Get()
 		for r.More() && r.Next() != '\r' {
-			arg += string(r.Get())
+			// Bytes are added as they are, so that UTF-8
+			// names pass through.
+			arg += string([]byte{r.Get()})
 		}
 	}
 
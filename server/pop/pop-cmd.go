@@ -1,8 +1,14 @@
 package pop
 
 import (
-	"fmt"
+	"bufio"
+	"encoding/base64"
+	"io"
+	"log"
+	"strconv"
 	"strings"
+
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
 /*
@@ -35,20 +41,154 @@ func cmdPass(s *session, c *command) {
 		return
 	}
 
-	box, err := s.auth(s.userName, c.arg)
-	if err != nil {
-		s.Err(err.Error())
+	if s.config.Auth.Verify(s.userName, c.arg) != nil {
+		s.Err("[AUTH] invalid credentials")
+		return
+	}
+	s.open(s.userName)
+}
+
+/*
+ * APOP <name> <digest>
+ */
+func cmdApop(s *session, c *command) {
+	if s.inbox != nil {
+		s.Err("Session already started")
+		return
+	}
+	v, ok := s.config.Auth.(DigestVerifier)
+	if !ok {
+		s.Err("APOP not available")
+		return
+	}
+	args := strings.Fields(c.arg)
+	if len(args) != 2 {
+		s.Err("The format is: APOP <name> <digest>")
+		return
+	}
+	if v.VerifyDigest(args[0], s.timestamp, args[1]) != nil {
+		s.Err("[AUTH] invalid credentials")
+		return
+	}
+	s.open(args[0])
+}
+
+/*
+ * AUTH <mechanism> [<initial-response>]
+ */
+func cmdAuth(s *session, c *command) {
+	if s.inbox != nil {
+		s.Err("Session already started")
+		return
+	}
+
+	args := strings.Fields(c.arg)
+	if len(args) == 0 || len(args) > 2 {
+		s.Err("The format is: AUTH <mechanism> [<initial-response>]")
+		return
+	}
+	m, ok := sasl.New(args[0], s.config.Auth)
+	if !ok {
+		s.Err("Unrecognized authentication type")
+		return
+	}
+
+	// A single "=" is an empty initial response (RFC 5034).
+	var response []byte
+	if len(args) == 2 {
+		var err error
+		response, err = decodeResponse(args[1])
+		if err != nil {
+			s.Err("Malformed initial response")
+			return
+		}
+	}
+
+	for {
+		challenge, done, err := m.Next(response)
+		if err == sasl.ErrSyntax {
+			s.Err("Malformed response")
+			return
+		}
+		if err != nil {
+			s.Err("[AUTH] invalid credentials")
+			return
+		}
+		if done {
+			break
+		}
+
+		s.Send("+ %s", base64.StdEncoding.EncodeToString(challenge))
+		line, err := s.readLine()
+		if err != nil {
+			log.Println(err)
+			s.closed = true
+			return
+		}
+		if line == "*" {
+			s.Err("Authentication cancelled")
+			return
+		}
+		response, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			s.Err("Malformed response")
+			return
+		}
+	}
+	s.open(m.User())
+}
+
+func decodeResponse(arg string) ([]byte, error) {
+	if arg == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(arg)
+}
+
+/*
+ * CAPA
+ *
+ * The list depends on the state: the commands for logging in are
+ * not shown after the login, and STLS is not shown after STLS.
+ */
+func cmdCapa(s *session, c *command) {
+	s.OK("Capability list follows")
+	for _, capa := range s.capabilities() {
+		s.Send("%s", capa)
+	}
+	s.Send(".")
+}
+
+/*
+ * STLS
+ */
+func cmdStls(s *session, c *command) {
+	if s.inbox != nil {
+		s.Err("STLS is allowed only before authorization")
+		return
+	}
+	if s.tls {
+		s.Err("Command not permitted when TLS active")
+		return
+	}
+	if s.starttls == nil {
+		s.Err("TLS not available")
 		return
 	}
 
-	m, err := makeInboxView(box)
+	s.OK("Begin TLS negotiation")
+	conn, err := s.starttls()
 	if err != nil {
-		s.Err(err.Error())
+		// The connection is in an undefined state now.
+		log.Printf("TLS handshake failed: %s", err.Error())
+		s.closed = true
 		return
 	}
 
-	s.inbox = m
-	s.OK("")
+	// Discard whatever was learned or buffered before the upgrade.
+	s.readWriter = makeReadWriter(conn)
+	s.tls = true
+	s.userName = ""
 }
 
 /*
@@ -107,18 +247,30 @@ func cmdRetr(s *session, c *command) {
 	}
 
 	entry := s.inbox.findEntry(c.arg)
-	if entry == nil {
+	if entry == nil || entry.deleted {
 		s.Err("no such message")
 		return
 	}
 
-	data, err := entry.msg.Content()
+	r, err := entry.msg.Open()
 	if err != nil {
-		s.Err(err.Error())
+		s.Err("[SYS/TEMP] " + err.Error())
 		return
 	}
+	defer r.Close()
+
 	s.OK("%d octets", entry.msg.Size())
-	s.SendData(data)
+	w := s.DataWriter()
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		// The response can't be finished properly.
+		log.Println(err)
+		s.closed = true
+		return
+	}
 	s.inbox.markRetrieved(entry)
 }
 
@@ -134,7 +286,7 @@ func cmdDele(s *session, c *command) {
 		s.Err(err.Error())
 		return
 	}
-	s.OK("message %d deleted", c.arg)
+	s.OK("message %s deleted", c.arg)
 }
 
 /*
@@ -178,7 +330,7 @@ func cmdUidl(s *session, c *command) {
 	if c.arg == "" {
 		s.OK("")
 		for _, entry := range s.inbox.entries() {
-			s.Send("%d %s", entry.id, entry.msg.Filename())
+			s.Send("%d %d", entry.id, entry.msg.UID())
 		}
 		s.Send(".")
 		return
@@ -189,61 +341,85 @@ func cmdUidl(s *session, c *command) {
 		s.Err("no such message")
 		return
 	}
-	s.OK("%d %s", msg.id, msg.msg.Filename())
+	s.OK("%d %d", msg.id, msg.msg.UID())
 }
 
 /*
  * TOP <msg> <n>
  */
 func cmdTop(s *session, c *command) {
-
-	var n int
-	var id string
-	_, err := fmt.Sscanf(c.arg, "%s %d", &id, &n)
-	if err != nil {
-		s.Err(err.Error())
+	if !checkAuth(s) {
 		return
 	}
 
-	entry := s.inbox.findEntry(id)
-	if entry == nil {
-		s.Err("No such message")
+	args := strings.Fields(c.arg)
+	if len(args) != 2 {
+		s.Err("The format is: TOP <msg> <n>")
+		return
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		s.Err("Invalid number of lines")
+		return
+	}
+	entry := s.inbox.findEntry(args[0])
+	if entry == nil || entry.deleted {
+		s.Err("no such message")
 		return
 	}
 
-	text, err := entry.msg.Content()
+	r, err := entry.msg.Open()
 	if err != nil {
-		s.Err(err.Error())
+		s.Err("[SYS/TEMP] " + err.Error())
 		return
 	}
+	defer r.Close()
 
-	lines := strings.Split(text, "\r\n")
-	size := len(lines)
-	i := 0
-
-	/*
-	 * Send all headers
-	 */
 	s.OK("")
-	for i < size {
-		s.Send("%s", lines[i])
-		if lines[i] == "" {
-			break
-		}
-		i++
+	w := s.DataWriter()
+	err = copyTop(w, r, n)
+	if err == nil {
+		err = w.Close()
 	}
+	if err != nil {
+		log.Println(err)
+		s.closed = true
+	}
+}
 
-	/*
-	 * Send no more than 'n' lines of the body
-	 */
-	i++
-	for i < size && n > 0 {
-		s.Send("---%d", n)
-		s.Send("%s", lines[i])
-		i++
-		n--
+// copyTop copies the header of a message, the empty line after it
+// and n first lines of the body. Long lines are copied in pieces,
+// so the message is never read into memory as a whole.
+func copyTop(w io.Writer, r io.Reader, n int) error {
+	br := bufio.NewReader(r)
+	header := true
+	lineStart := true
+	for header || n > 0 {
+		chunk, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return err
+		}
+		_, werr := w.Write(chunk)
+		if werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err == bufio.ErrBufferFull {
+			lineStart = false
+			continue
+		}
+
+		// A whole line, or the last piece of one, is done.
+		if !header {
+			n--
+		} else if lineStart && (string(chunk) == "\r\n" || string(chunk) == "\n") {
+			header = false
+		}
+		lineStart = true
 	}
-	s.Send(".")
+	return nil
 }
 
 func checkAuth(s *session) bool {
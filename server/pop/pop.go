@@ -1,14 +1,49 @@
 package pop
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/gaswelder/ring2/server/mailbox"
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
-type AuthFunc func(name, password string) (*mailbox.Mailbox, error)
+// Config describes the environment POP sessions work in.
+type Config struct {
+	// Auth checks credentials given with PASS and AUTH.
+	Auth sasl.Backend
+	// Open returns the maildrop of an authenticated user.
+	Open func(name string) (*mailbox.Mailbox, error)
+	// Hostname is used in the greeting's timestamp.
+	Hostname string
+	// TLS tells that connections are TLS from the first byte.
+	TLS bool
+}
+
+// DigestVerifier is implemented by backends that support
+// the APOP command.
+type DigestVerifier interface {
+	// VerifyDigest returns an error if the digest wasn't made
+	// from the timestamp and the user's password.
+	VerifyDigest(name, timestamp, digest string) error
+}
+
+// Digest returns the APOP digest for the timestamp and password:
+// MD5 of their concatenation in lowercase hex (RFC 1939).
+func Digest(timestamp, password string) string {
+	sum := md5.Sum([]byte(timestamp + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// TLSFunc upgrades the session's connection to TLS and returns
+// the stream to continue the session over.
+type TLSFunc func() (io.ReadWriter, error)
 
 type popfunc func(s *session, c *command)
 
@@ -25,16 +60,37 @@ var popFuncs = map[string]popfunc{
 	// Optional
 	"UIDL": cmdUidl,
 	"TOP":  cmdTop,
+	"STLS": cmdStls,
+	"AUTH": cmdAuth,
+	"CAPA": cmdCapa,
+	"APOP": cmdApop,
 }
 
-func Process(conn io.ReadWriter, auth AuthFunc) {
-	s := makeSession(conn, auth)
-	s.OK("Hello")
-	for {
-		cmd, err := s.readCommand()
-		if err == io.EOF {
+// Process runs a POP session over the given connection.
+// If starttls is not nil, the STLS command is available.
+func Process(conn io.ReadWriter, config *Config, starttls TLSFunc) {
+	s := makeSession(conn, config, starttls)
+	// The greeting has a timestamp for APOP if it's supported.
+	if _, ok := config.Auth.(DigestVerifier); ok {
+		s.timestamp = fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), config.Hostname)
+		s.OK("Hello %s", s.timestamp)
+	} else {
+		s.OK("Hello")
+	}
+	// The maildrop is released on QUIT as well
+	// as when the connection breaks.
+	defer s.close()
+	for !s.closed {
+		// A broken connection ends the session
+		// like the end of input.
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
 			break
 		}
+		cmd, err := parseCommand(line)
 		if err != nil {
 			s.Err(err.Error())
 			continue
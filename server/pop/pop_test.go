@@ -0,0 +1,356 @@
+package pop
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaswelder/ring2/server/internal/testutil"
+	"github.com/gaswelder/ring2/server/mailbox"
+	"github.com/gaswelder/ring2/server/sasl"
+)
+
+// testUsers adds APOP to the test backend.
+type testUsers struct {
+	testutil.Users
+}
+
+func (u testUsers) VerifyDigest(name, timestamp, digest string) error {
+	p, ok := u.Users[name]
+	if !ok || Digest(timestamp, p) != digest {
+		return sasl.ErrInvalid
+	}
+	return nil
+}
+
+func testConfig(t *testing.T) *Config {
+	return &Config{
+		Auth: testUsers{testutil.Users{"joe": "123", "josé": "123"}},
+		Open: func(name string) (*mailbox.Mailbox, error) {
+			if name != "joe" && name != "josé" {
+				return nil, errors.New("unknown user")
+			}
+			return mailbox.New(t.TempDir())
+		},
+		Hostname: "localhost",
+	}
+}
+
+// replies returns the first words of the replies.
+func replies(text string) string {
+	words := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n") {
+		words = append(words, strings.Fields(line)[0])
+	}
+	return strings.Join(words, " ")
+}
+
+func TestAuth(t *testing.T) {
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	cases := []struct {
+		script   string
+		expected string
+	}{
+		{"USER joe\r\nPASS 123\r\n", "+OK +OK"},
+		{"USER josé\r\nPASS 123\r\n", "+OK +OK"},
+		{"USER joe\r\nPASS 124\r\n", "+OK -ERR"},
+		{"AUTH PLAIN " + b64("\x00joe\x00123") + "\r\n", "+OK"},
+		{"AUTH PLAIN\r\n" + b64("\x00joe\x00123") + "\r\n", "+ +OK"},
+		{"AUTH PLAIN =\r\n", "-ERR"},
+		{"AUTH LOGIN\r\n" + b64("joe") + "\r\n" + b64("124") + "\r\n", "+ + -ERR"},
+		{"AUTH LOGIN\r\n*\r\n", "+ -ERR"},
+		{"AUTH NTLM\r\n", "-ERR"},
+	}
+	for _, c := range cases {
+		conn := &testutil.Recorder{Reader: strings.NewReader(c.script + "STAT\r\nQUIT\r\n")}
+		Process(conn, testConfig(t), nil)
+
+		// STAT works only after a successful authentication.
+		expected := "+OK " + c.expected
+		if strings.HasSuffix(c.expected, "+OK") {
+			expected += " +OK +OK"
+		} else {
+			expected += " -ERR +OK"
+		}
+		if replies(conn.String()) != expected {
+			t.Errorf("%q: expected %s, got %q", c.script, expected, conn.String())
+		}
+	}
+}
+
+func TestCapa(t *testing.T) {
+	conn := &testutil.Recorder{Reader: strings.NewReader("CAPA\r\nUSER joe\r\nPASS 124\r\nUSER joe\r\nPASS 123\r\nCAPA\r\nQUIT\r\n")}
+	Process(conn, testConfig(t), nil)
+
+	expected := "+OK Capability list follows\r\n" +
+		"TOP\r\nUIDL\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\n" +
+		"USER\r\nSASL PLAIN LOGIN CRAM-MD5 SCRAM-SHA-256\r\n.\r\n" +
+		"+OK\r\n-ERR [AUTH] invalid credentials\r\n+OK\r\n+OK\r\n" +
+		"+OK Capability list follows\r\n" +
+		"TOP\r\nUIDL\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\n.\r\n" +
+		"+OK\r\n"
+	// Skip the greeting.
+	replies := conn.String()
+	replies = replies[strings.Index(replies, "\r\n")+2:]
+	if replies != expected {
+		t.Errorf("unexpected replies: %q", replies)
+	}
+}
+
+func TestApop(t *testing.T) {
+	apop := func(name, password string) string {
+		server, client := net.Pipe()
+		defer client.Close()
+		go func() {
+			Process(server, testConfig(t), nil)
+			server.Close()
+		}()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		c := textproto.NewConn(client)
+
+		greeting, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp := regexp.MustCompile(`<[^>]+@localhost>`).FindString(greeting)
+		if timestamp == "" {
+			t.Fatalf("no timestamp in the greeting: %q", greeting)
+		}
+		c.PrintfLine("APOP %s %s", name, Digest(timestamp, password))
+		reply, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.PrintfLine("QUIT")
+		c.ReadLine()
+		return reply
+	}
+
+	if r := apop("joe", "123"); r != "+OK" {
+		t.Errorf("unexpected reply: %q", r)
+	}
+	if r := apop("joe", "124"); r != "-ERR [AUTH] invalid credentials" {
+		t.Errorf("unexpected reply: %q", r)
+	}
+}
+
+func TestMaildropLock(t *testing.T) {
+	dir := t.TempDir()
+	config := testConfig(t)
+	config.Open = func(name string) (*mailbox.Mailbox, error) {
+		return mailbox.New(dir)
+	}
+
+	// The first session holds the maildrop while the second
+	// one tries to log in.
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		Process(server, config, nil)
+		server.Close()
+		done <- true
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	c := textproto.NewConn(client)
+	c.ReadLine()
+	c.PrintfLine("USER joe")
+	c.ReadLine()
+	c.PrintfLine("PASS 123")
+	if line, _ := c.ReadLine(); line != "+OK" {
+		t.Fatalf("unexpected reply: %q", line)
+	}
+
+	login := func() string {
+		conn := &testutil.Recorder{Reader: strings.NewReader("USER joe\r\nPASS 123\r\nQUIT\r\n")}
+		Process(conn, config, nil)
+		return replies(conn.String())
+	}
+	if r := login(); r != "+OK +OK -ERR +OK" {
+		t.Errorf("unexpected replies: %s", r)
+	}
+	if !strings.Contains(login(), "-ERR") {
+		t.Errorf("the maildrop is not locked")
+	}
+
+	// The lock is released when the connection breaks.
+	client.Close()
+	<-done
+	if r := login(); r != "+OK +OK +OK +OK" {
+		t.Errorf("unexpected replies: %s", r)
+	}
+}
+
+func TestDataWriter(t *testing.T) {
+	cases := []struct{ data, expected string }{
+		{"", ".\r\n"},
+		{"Hello\r\n", "Hello\r\n.\r\n"},
+		{"Hello", "Hello\r\n.\r\n"},
+		{".\r\n..a\r\nb.c\r\n.", "..\r\n...a\r\nb.c\r\n..\r\n.\r\n"},
+	}
+	for _, c := range cases {
+		conn := &testutil.Recorder{Reader: strings.NewReader("")}
+		w := makeReadWriter(conn).DataWriter()
+		// Byte by byte, so that the pieces split the lines.
+		for i := 0; i < len(c.data); i++ {
+			w.Write([]byte{c.data[i]})
+		}
+		w.Close()
+		if conn.String() != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.data, c.expected, conn.String())
+		}
+	}
+}
+
+func TestTop(t *testing.T) {
+	dir := t.TempDir()
+	box, _ := mailbox.New(dir)
+	config := testConfig(t)
+	config.Open = func(name string) (*mailbox.Mailbox, error) {
+		return box, nil
+	}
+
+	// A message that is much bigger than any buffer, with
+	// a huge line right after the header.
+	long := strings.Repeat("x", 100000)
+	var text strings.Builder
+	text.WriteString("Subject: hi\r\nFrom: joe\r\n\r\n" + long + "\r\n.dot\r\n")
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&text, "line %d\r\n", i)
+	}
+	err := box.Add(strings.NewReader(text.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &testutil.Recorder{Reader: strings.NewReader("TOP 1 0\r\n" +
+		"USER joe\r\nPASS 123\r\n" +
+		"TOP 1 0\r\n" +
+		"TOP 1 2\r\n" +
+		"TOP 1 3\r\n" +
+		"TOP 1\r\n" +
+		"TOP 2 1\r\n" +
+		"RETR 1\r\n" +
+		"DELE 1\r\n" +
+		"RETR 1\r\n" +
+		"TOP 1 0\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+	out := conn.String()
+
+	expected := []string{
+		"-ERR Unauthorized\r\n+OK\r\n+OK\r\n",
+		"+OK\r\nSubject: hi\r\nFrom: joe\r\n\r\n.\r\n",
+		"+OK\r\nSubject: hi\r\nFrom: joe\r\n\r\n" + long + "\r\n..dot\r\n.\r\n",
+		"+OK\r\nSubject: hi\r\nFrom: joe\r\n\r\n" + long + "\r\n..dot\r\nline 0\r\n.\r\n",
+		"-ERR The format is: TOP <msg> <n>\r\n",
+		"-ERR no such message\r\n",
+		fmt.Sprintf("+OK %d octets\r\n", text.Len()) + strings.Replace(text.String(), "\r\n.dot", "\r\n..dot", 1) + ".\r\n",
+		"+OK message 1 deleted\r\n",
+		"-ERR no such message\r\n",
+		"-ERR no such message\r\n",
+		"+OK\r\n",
+	}
+	// Skip the greeting.
+	out = out[strings.Index(out, "\r\n")+2:]
+	for i, e := range expected {
+		if !strings.HasPrefix(out, e) {
+			n := len(e)
+			if n > len(out) {
+				n = len(out)
+			}
+			t.Fatalf("reply %d: expected %.200q, got %.200q", i, e, out[:n])
+		}
+		out = out[len(e):]
+	}
+	if out != "" {
+		t.Errorf("unexpected replies at the end: %.200q", out)
+	}
+}
+
+func TestStls(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{testutil.Cert(t)}}
+	starttls := func() (io.ReadWriter, error) {
+		conn := tls.Server(server, tlsConfig)
+		return conn, conn.Handshake()
+	}
+	go func() {
+		Process(server, testConfig(t), starttls)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Sends a command and returns the reply with
+	// the lines of a multiline one.
+	c := textproto.NewConn(client)
+	cmd := func(line string) string {
+		c.PrintfLine("%s", line)
+		reply, err := c.ReadLine()
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if line != "CAPA" || !strings.HasPrefix(reply, "+OK") {
+			return reply
+		}
+		lines, err := c.ReadDotLines()
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		return reply + " " + strings.Join(lines, " ")
+	}
+	c.ReadLine()
+	if r := cmd("CAPA"); !strings.HasSuffix(r, " STLS") {
+		t.Errorf("STLS is not advertised: %q", r)
+	}
+	cmd("USER joe")
+	if r := cmd("STLS"); !strings.HasPrefix(r, "+OK") {
+		t.Fatalf("unexpected reply: %q", r)
+	}
+
+	conn := tls.Client(client, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = textproto.NewConn(conn)
+
+	// The user name given before the upgrade is forgotten.
+	if r := cmd("PASS 123"); !strings.HasPrefix(r, "-ERR") {
+		t.Errorf("unexpected reply: %q", r)
+	}
+	if r := cmd("CAPA"); strings.Contains(r, "STLS") {
+		t.Errorf("STLS is advertised over TLS: %q", r)
+	}
+	if r := cmd("STLS"); r != "-ERR Command not permitted when TLS active" {
+		t.Errorf("unexpected reply: %q", r)
+	}
+	cmd("USER joe")
+	if r := cmd("PASS 123"); r != "+OK" {
+		t.Errorf("unexpected reply: %q", r)
+	}
+	cmd("QUIT")
+}
+
+func TestImplicitTLS(t *testing.T) {
+	config := testConfig(t)
+	config.TLS = true
+	conn := &testutil.Recorder{Reader: strings.NewReader("CAPA\r\nSTLS\r\nQUIT\r\n")}
+	Process(conn, config, nil)
+	if strings.Contains(conn.String(), "STLS\r\n") {
+		t.Errorf("STLS is advertised over TLS: %q", conn.String())
+	}
+	if !strings.Contains(conn.String(), "-ERR Command not permitted when TLS active\r\n") {
+		t.Errorf("unexpected replies: %q", conn.String())
+	}
+}
@@ -19,12 +19,14 @@ func makeReadWriter(c io.ReadWriter) *readWriter {
 	}
 }
 
-func (rw *readWriter) readCommand() (*command, error) {
+// readLine reads a line that is not a command,
+// without the line ending.
+func (rw *readWriter) readLine() (string, error) {
 	line, err := rw.reader.ReadString('\n')
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return parseCommand(line)
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
 // Send a success response with optional comment
@@ -52,26 +54,43 @@ func (rw *readWriter) Send(format string, args ...interface{}) error {
 	return err
 }
 
-// Send a multiline data
-func (rw *readWriter) SendData(data string) error {
-	var err error
-	lines := strings.Split(data, "\r\n")
-	for _, line := range lines {
-		err = rw.SendDataLine(line)
-		if err != nil {
-			return err
+// DataWriter returns a writer for the body of a multiline response.
+// Lines are dot-stuffed as they are written, and Close ends the
+// response with the termination line.
+func (rw *readWriter) DataWriter() io.WriteCloser {
+	return &dataWriter{
+		w:         bufio.NewWriter(rw.writer),
+		lineStart: true,
+	}
+}
+
+type dataWriter struct {
+	w *bufio.Writer
+	// Whether the next byte starts a line.
+	lineStart bool
+}
+
+func (d *dataWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if d.lineStart && c == '.' {
+			if err := d.w.WriteByte('.'); err != nil {
+				return i, err
+			}
 		}
+		if err := d.w.WriteByte(c); err != nil {
+			return i, err
+		}
+		d.lineStart = c == '\n'
 	}
-	err = rw.Send(".")
-	return err
+	return len(p), nil
 }
 
-// Sends a line of data, taking care of the "dot-stuffing"
-func (rw *readWriter) SendDataLine(line string) error {
-	if len(line) > 0 && line[0] == '.' {
-		line = "." + line
+// Close terminates the response. If the data doesn't end
+// with a line break, one is added.
+func (d *dataWriter) Close() error {
+	if !d.lineStart {
+		d.w.WriteString("\r\n")
 	}
-	line += "\r\n"
-	_, err := rw.writer.Write([]byte(line))
-	return err
+	d.w.WriteString(".\r\n")
+	return d.w.Flush()
 }
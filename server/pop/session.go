@@ -2,18 +2,92 @@ package pop
 
 import (
 	"io"
+	"log"
+	"strings"
+
+	"github.com/gaswelder/ring2/server/mailbox"
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
 type session struct {
 	userName string
 	inbox    *inboxView
 	*readWriter
-	auth AuthFunc
+	config *Config
+	// Upgrades the connection, nil if TLS is not available.
+	starttls TLSFunc
+	// Whether the session runs over TLS.
+	tls bool
+	// Set when the connection can't be used anymore.
+	closed bool
+	// Timestamp from the greeting, empty if APOP is not available.
+	timestamp string
+}
+
+// open starts the transaction state with the user's maildrop.
+// The maildrop stays locked until the session ends.
+func (s *session) open(name string) {
+	box, err := s.config.Open(name)
+	if err != nil {
+		s.Err("[SYS/TEMP] " + err.Error())
+		return
+	}
+
+	err = box.Lock()
+	if err == mailbox.ErrLocked {
+		s.Err("[IN-USE] maildrop is already in use")
+		return
+	}
+	if err != nil {
+		s.Err("[SYS/TEMP] " + err.Error())
+		return
+	}
+
+	m, err := makeInboxView(box)
+	if err != nil {
+		box.Unlock()
+		s.Err("[SYS/TEMP] " + err.Error())
+		return
+	}
+
+	s.inbox = m
+	s.OK("")
+}
+
+// close releases the maildrop, if there is one.
+func (s *session) close() {
+	if s.inbox == nil {
+		return
+	}
+	err := s.inbox.box.Unlock()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// capabilities returns the CAPA list of the session (RFC 2449).
+func (s *session) capabilities() []string {
+	list := []string{
+		"TOP",
+		"UIDL",
+		"RESP-CODES",
+		"AUTH-RESP-CODE",
+		"PIPELINING",
+	}
+	if s.inbox == nil {
+		list = append(list, "USER", "SASL "+strings.Join(sasl.Names(), " "))
+		if s.starttls != nil && !s.tls {
+			list = append(list, "STLS")
+		}
+	}
+	return list
 }
 
-func makeSession(c io.ReadWriter, auth AuthFunc) *session {
+func makeSession(c io.ReadWriter, config *Config, starttls TLSFunc) *session {
 	return &session{
 		readWriter: makeReadWriter(c),
-		auth:       auth,
+		config:     config,
+		starttls:   starttls,
+		tls:        config.TLS,
 	}
 }
@@ -0,0 +1,368 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gaswelder/ring2/server/dsn"
+)
+
+// Resolver looks up mail exchangers of domains.
+// *net.Resolver satisfies it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+var defaultResolver Resolver = net.DefaultResolver
+
+const dialTimeout = 30 * time.Second
+
+// permanentError is a delivery failure that won't go away
+// if the delivery is retried.
+type permanentError struct {
+	msg string
+	// Status code to report, if it's more specific than 5.0.0.
+	status string
+}
+
+func (e *permanentError) Error() string {
+	return e.msg
+}
+
+// isPermanent returns true if the error is not worth retrying.
+func isPermanent(err error) bool {
+	var perr *permanentError
+	if errors.As(err, &perr) {
+		return true
+	}
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return terr.Code >= 500
+	}
+	return false
+}
+
+// setError records a delivery error for the recipient.
+func (r *Recipient) setError(err error) {
+	r.Error = err.Error()
+	r.Reply = ""
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		r.Reply = fmt.Sprintf("%d %s", terr.Code, terr.Msg)
+		r.Status = replyStatus(terr.Code, terr.Msg)
+		return
+	}
+	var perr *permanentError
+	if errors.As(err, &perr) && perr.status != "" {
+		r.Status = perr.status
+	} else if isPermanent(err) {
+		r.Status = "5.0.0"
+	} else {
+		// Network and routing problems.
+		r.Status = "4.4.1"
+	}
+}
+
+// replyStatus returns the status code for a reply of a remote
+// server, taking the enhanced code from the text if it's there.
+func replyStatus(code int, text string) string {
+	f := strings.Fields(text)
+	if len(f) > 0 && isStatusCode(f[0]) {
+		return f[0]
+	}
+	return fmt.Sprintf("%d.0.0", code/100)
+}
+
+// isStatusCode returns true if the string looks like an
+// enhanced status code like "5.1.1".
+func isStatusCode(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 || len(p) > 3 {
+			return false
+		}
+		for _, c := range p {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// deliver sends the message to recipients in the given domain.
+// Returns delivery errors for each recipient, nil for those
+// that the message was delivered to. The flag tells whether the
+// server that took the message also took the responsibility for
+// delivery status notifications.
+func (q *Queue) deliver(id string, env *Envelope, domain string, rcpts []*Recipient) ([]error, bool) {
+	errs := make([]error, len(rcpts))
+	targets, err := q.targets(domain)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, false
+	}
+
+	// Try the servers in order of preference until one of them
+	// gets far enough to respond to the recipients.
+	for _, t := range targets {
+		var passed bool
+		errs, passed, err = q.send(t, id, env, rcpts)
+		if err == nil {
+			return errs, passed
+		}
+		if isPermanent(err) {
+			break
+		}
+	}
+	errs = make([]error, len(rcpts))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs, false
+}
+
+// target is a server messages are handed over to.
+type target struct {
+	host string
+	port string
+	tls  string
+	// Credentials, if the server requires authentication.
+	user     string
+	password string
+}
+
+// targets returns servers that accept mail for the domain,
+// most preferred first.
+func (q *Queue) targets(domain string) ([]*target, error) {
+	if q.Smarthost != nil {
+		h := q.Smarthost
+		return []*target{{h.Host, h.Port, h.TLS, h.User, h.Password}}, nil
+	}
+	hosts, err := q.exchangers(domain)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*target, 0, len(hosts))
+	for _, host := range hosts {
+		targets = append(targets, &target{host: host, port: q.Port, tls: tlsOpportunistic})
+	}
+	return targets, nil
+}
+
+// exchangers returns hosts accepting mail for the domain,
+// most preferred first.
+func (q *Queue) exchangers(domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	mxs, err := q.Resolver.LookupMX(ctx, domain)
+
+	// If there are no MX records, the domain itself is
+	// the exchanger (RFC 5321, 5.1).
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound || err == nil && len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A single "." exchanger means the domain doesn't accept mail
+	// (RFC 7505).
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, &permanentError{msg: fmt.Sprintf("domain %s does not accept mail", domain)}
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// send transfers the message to the given server. If the transaction
+// fails before the recipients are given, returns an error. Otherwise
+// returns an error for each recipient, nil for successful ones, and
+// whether the server supports DSN.
+func (q *Queue) send(t *target, id string, env *Envelope, rcpts []*Recipient) ([]error, bool, error) {
+	c, err := q.dial(t)
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+
+	// If the server supports DSN, the parameters are passed along
+	// and the notifications become its responsibility.
+	passed, _ := c.Extension("DSN")
+
+	params := ""
+	if env.UTF8 {
+		// Internationalized addresses can't be downgraded,
+		// so the message can't go to this server at all.
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			c.Quit()
+			return nil, false, &permanentError{"the server does not support SMTPUTF8", "5.6.7"}
+		}
+		params += " SMTPUTF8"
+	}
+	if ok, _ := c.Extension("8BITMIME"); ok && env.Body != "" {
+		params += " BODY=" + env.Body
+	} else if env.Body == "8BITMIME" {
+		// An 8-bit body can't go to a 7-bit server (RFC 6152),
+		// and the message is not converted.
+		c.Quit()
+		return nil, false, &permanentError{"the server does not support 8BITMIME", "5.6.3"}
+	}
+	if passed && env.Ret != "" {
+		params += " RET=" + env.Ret
+	}
+	if passed && env.EnvID != "" {
+		params += " ENVID=" + dsn.EncodeXtext(env.EnvID)
+	}
+	err = command(c, 250, "MAIL FROM:<%s>%s", env.From, params)
+	if err != nil {
+		return nil, false, err
+	}
+
+	errs := make([]error, len(rcpts))
+	accepted := 0
+	for i, r := range rcpts {
+		params := ""
+		if passed && len(r.Notify) > 0 {
+			params += " NOTIFY=" + strings.Join(r.Notify, ",")
+		}
+		if passed && r.ORCPT != "" {
+			params += " ORCPT=" + dsn.EncodeXtext(r.ORCPT)
+		}
+		errs[i] = command(c, 25, "RCPT TO:<%s>%s", r.Addr, params)
+		if errs[i] == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		c.Quit()
+		return errs, passed, nil
+	}
+
+	err = q.data(c, id)
+	if err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs, passed, nil
+	}
+	c.Quit()
+	return errs, passed, nil
+}
+
+// command sends a command and checks the reply code. net/smtp's
+// Mail and Rcpt methods can't be used because they don't take
+// parameters.
+func command(c *smtp.Client, expectCode int, format string, args ...interface{}) error {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+// dial connects to the server and gets the session to the point
+// where the mail transaction can begin.
+func (q *Queue) dial(t *target) (*smtp.Client, error) {
+	addr := net.JoinHostPort(t.host, t.port)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if t.tls == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: t.host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, t.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = c.Hello(q.Hostname)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	ok, _ := c.Extension("STARTTLS")
+	switch {
+	case t.tls == TLSStartTLS && !ok:
+		c.Close()
+		return nil, fmt.Errorf("%s doesn't support STARTTLS", t.host)
+	case t.tls == TLSStartTLS:
+		err = c.StartTLS(&tls.Config{ServerName: t.host})
+	case t.tls == tlsOpportunistic && ok:
+		// Certificates of exchangers are rarely valid for the names
+		// they are found by, so this only protects against passive
+		// eavesdropping.
+		err = c.StartTLS(&tls.Config{ServerName: t.host, InsecureSkipVerify: true})
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if t.user != "" {
+		err = c.Auth(clientAuth(c, t))
+		if err != nil {
+			// Rejected credentials are a configuration problem
+			// which can be fixed before the message expires, so
+			// this is reported as a temporary failure.
+			c.Close()
+			return nil, fmt.Errorf("authentication failed: %s", err.Error())
+		}
+	}
+	return c, nil
+}
+
+// data sends the message text after the DATA command.
+func (q *Queue) data(c *smtp.Client, id string) error {
+	f, err := os.Open(q.textPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,422 @@
+// Package queue keeps outgoing messages on disk and delivers them
+// to remote mail servers.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gaswelder/ring2/server/dsn"
+)
+
+// NotifyFunc sends a delivery status notification to the sender
+// of a message.
+type NotifyFunc func(sender string, text io.Reader) error
+
+// Queue is a directory with messages waiting to be delivered.
+// Each message is kept as two files: the text itself and its
+// envelope with the recipients and the delivery state.
+type Queue struct {
+	dir string
+
+	// Hostname is the name the queue introduces itself with
+	// to remote servers.
+	Hostname string
+	// Resolver is used to find mail exchangers of domains.
+	Resolver Resolver
+	// Port is the port remote servers are contacted on.
+	Port string
+	// Smarthost, if set, is the server all mail is sent through.
+	Smarthost *Smarthost
+	// Notify is called to send delivery status notifications,
+	// including bounces. Messages with empty senders never get
+	// notifications.
+	Notify NotifyFunc
+	// Retry is the delay before the first retry. Every next retry
+	// waits twice as long, but not longer than MaxRetry.
+	Retry    time.Duration
+	MaxRetry time.Duration
+	// Expire is how long a message may stay in the queue before
+	// it's given up on and bounced.
+	Expire time.Duration
+
+	wake chan struct{}
+	stop chan struct{}
+}
+
+// Envelope of a queued message.
+type Envelope struct {
+	From string
+	// Recipients that haven't been delivered to yet.
+	To []*Recipient
+	// DSN parameters of the message (RFC 3461).
+	EnvID string
+	Ret   string
+	// Body type from the BODY parameter (RFC 6152).
+	Body string
+	// Set if the message needs SMTPUTF8 (RFC 6531).
+	UTF8 bool
+
+	// Delivery state
+	Created  time.Time
+	Attempts int
+	Next     time.Time
+}
+
+// Recipient of a queued message.
+type Recipient struct {
+	Addr string
+	// DSN parameters of the recipient (RFC 3461).
+	Notify []string
+	ORCPT  string
+
+	// The last delivery error, if there were attempts.
+	Error string
+	// Status code of the last error (RFC 3463).
+	Status string
+	// The last error as replied by the remote server, if it was
+	// reported by one.
+	Reply string
+	// Set when the sender has been notified about the delay.
+	Delayed bool
+}
+
+// New returns a queue that keeps its data in the given directory.
+func New(dir string) (*Queue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{
+		dir:      dir,
+		Hostname: "localhost",
+		Resolver: defaultResolver,
+		Port:     "25",
+		Retry:    5 * time.Minute,
+		MaxRetry: 4 * time.Hour,
+		Expire:   5 * 24 * time.Hour,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Add puts a message into the queue.
+func (q *Queue) Add(env *Envelope, text io.Reader) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	env.Created = now
+	env.Next = now
+
+	// The envelope is written last, so that a message without
+	// an envelope is never picked up half-written.
+	err = writeFile(q.textPath(id), text)
+	if err != nil {
+		os.Remove(q.textPath(id))
+		return err
+	}
+	err = q.save(id, env)
+	if err != nil {
+		os.Remove(q.textPath(id))
+		return err
+	}
+	to := make([]string, 0, len(env.To))
+	for _, r := range env.To {
+		to = append(to, r.Addr)
+	}
+	log.Printf("Queued message %s for %s", id, strings.Join(to, ", "))
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers queued messages as they become due.
+// It returns after Close is called.
+func (q *Queue) Run() {
+	for {
+		next := q.process(time.Now())
+
+		// With nothing to retry there's nothing to wait for
+		// except new messages.
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		case <-q.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// Close stops the delivery loop. Queued messages stay on disk.
+func (q *Queue) Close() {
+	close(q.stop)
+}
+
+// process makes a delivery attempt for all messages due at the
+// given time and returns the time the next message is due.
+// Returns zero time if the queue is empty.
+func (q *Queue) process(now time.Time) time.Time {
+	ids, err := q.list()
+	if err != nil {
+		log.Printf("queue: %s", err.Error())
+		return now.Add(q.Retry)
+	}
+
+	var next time.Time
+	for _, id := range ids {
+		env, err := q.load(id)
+		if err != nil {
+			log.Printf("queue: %s: %s", id, err.Error())
+			continue
+		}
+		if env.Next.After(now) {
+			next = earliest(next, env.Next)
+			continue
+		}
+		if q.attempt(id, env, now) {
+			next = earliest(next, env.Next)
+		}
+	}
+	return next
+}
+
+// attempt tries to deliver a message to all its pending recipients.
+// Returns true if the message remains in the queue.
+func (q *Queue) attempt(id string, env *Envelope, now time.Time) bool {
+	env.Attempts++
+
+	// Recipients are grouped by domain because each domain
+	// may be served by different exchangers. With a smarthost
+	// all recipients go in one transaction.
+	domains := make(map[string][]*Recipient)
+	for _, r := range env.To {
+		d := ""
+		if q.Smarthost == nil {
+			d = domain(r.Addr)
+		}
+		domains[d] = append(domains[d], r)
+	}
+
+	expired := now.Sub(env.Created) >= q.Expire
+	pending := make([]*Recipient, 0)
+
+	// Statuses the sender has asked to be notified about.
+	statuses := make([]*dsn.Recipient, 0)
+	report := func(r *Recipient, action, code, reason string) {
+		if dsn.Requested(r.Notify, action) {
+			statuses = append(statuses, r.status(action, code, reason))
+		}
+	}
+
+	for d, rcpts := range domains {
+		errs, passed := q.deliver(id, env, d, rcpts)
+		for i, r := range rcpts {
+			err := errs[i]
+			if err == nil {
+				log.Printf("queue: %s: delivered to %s", id, r.Addr)
+				// If the next server doesn't support DSN, the
+				// sender won't hear from it, so the delivery is
+				// reported as "relayed".
+				if !passed {
+					report(r, dsn.Relayed, "2.0.0", "")
+				}
+				continue
+			}
+			log.Printf("queue: %s: %s: %s", id, r.Addr, err.Error())
+			r.setError(err)
+			switch {
+			case isPermanent(err):
+				report(r, dsn.Failed, r.Status, r.Error)
+			case expired:
+				report(r, dsn.Failed, r.Status, "Delivery time expired, last error: "+r.Error)
+			default:
+				if !r.Delayed {
+					r.Delayed = true
+					report(r, dsn.Delayed, r.Status, r.Error)
+				}
+				pending = append(pending, r)
+			}
+		}
+	}
+
+	q.notify(id, env, statuses)
+
+	if len(pending) == 0 {
+		q.remove(id)
+		return false
+	}
+
+	env.To = pending
+	env.Next = now.Add(q.backoff(env.Attempts))
+	err := q.save(id, env)
+	if err != nil {
+		log.Printf("queue: %s: %s", id, err.Error())
+	}
+	return true
+}
+
+// status returns a delivery status report entry for the recipient.
+func (r *Recipient) status(action, code, reason string) *dsn.Recipient {
+	st := &dsn.Recipient{
+		Original: r.ORCPT,
+		Final:    r.Addr,
+		Action:   action,
+		Status:   code,
+		Reason:   reason,
+	}
+	if action != dsn.Relayed {
+		st.Diagnostic = r.Reply
+	}
+	return st
+}
+
+// backoff returns the delay after the given number of attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.Retry
+	for i := 1; i < attempts && d < q.MaxRetry; i++ {
+		d *= 2
+	}
+	if d > q.MaxRetry {
+		d = q.MaxRetry
+	}
+	return d
+}
+
+// notify sends the sender a report with the given statuses.
+func (q *Queue) notify(id string, env *Envelope, statuses []*dsn.Recipient) {
+	if env.From == "" || q.Notify == nil || len(statuses) == 0 {
+		return
+	}
+
+	text, err := os.Open(q.textPath(id))
+	if err != nil {
+		log.Printf("queue: %s: %s", id, err.Error())
+		return
+	}
+	defer text.Close()
+	report := &dsn.Report{
+		ReportingMTA: q.Hostname,
+		To:           env.From,
+		Arrival:      env.Created,
+		Recipients:   statuses,
+		Original:     text,
+		HeadersOnly:  env.Ret == dsn.RetHdrs,
+		EnvID:        env.EnvID,
+	}
+	err = q.Notify(env.From, report.Reader())
+	if err != nil {
+		log.Printf("queue: %s: notification to %s failed: %s", id, env.From, err.Error())
+	}
+}
+
+// Returns identifiers of all queued messages, oldest first.
+func (q *Queue) list() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*.env"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(paths))
+	for _, path := range paths {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(path), ".env"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (q *Queue) load(id string) (*Envelope, error) {
+	data, err := ioutil.ReadFile(q.envelopePath(id))
+	if err != nil {
+		return nil, err
+	}
+	env := new(Envelope)
+	err = json.Unmarshal(data, env)
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// Writes the envelope, replacing the old one atomically.
+func (q *Queue) save(id string, env *Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	tmp := q.envelopePath(id) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.envelopePath(id))
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (q *Queue) remove(id string) {
+	os.Remove(q.envelopePath(id))
+	os.Remove(q.textPath(id))
+}
+
+func (q *Queue) envelopePath(id string) string {
+	return filepath.Join(q.dir, id+".env")
+}
+
+func (q *Queue) textPath(id string) string {
+	return filepath.Join(q.dir, id+".msg")
+}
+
+// Returns a new message identifier. Identifiers sort in the
+// order the messages were queued.
+func newID() (string, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%x", time.Now().UnixNano(), b), nil
+}
+
+// Returns the domain part of an address.
+func domain(addr string) string {
+	pos := strings.LastIndex(addr, "@")
+	return strings.ToLower(addr[pos+1:])
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,361 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver points every domain to the same host.
+type fakeResolver struct {
+	host string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return []*net.MX{{Host: r.host + ".", Pref: 10}}, nil
+}
+
+// sink is a minimal SMTP server that records received messages.
+type sink struct {
+	ln net.Listener
+	// Reply code for RCPT commands.
+	rcptCode int
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func newSink(t *testing.T) *sink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sink{ln: ln, rcptCode: 250}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *sink) port() string {
+	_, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return port
+}
+
+func (s *sink) setCode(code int) {
+	s.mu.Lock()
+	s.rcptCode = code
+	s.mu.Unlock()
+}
+
+func (s *sink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+func (s *sink) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *sink) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 sink\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprintf(conn, "250 sink\r\n")
+		case strings.HasPrefix(cmd, "RCPT"):
+			s.mu.Lock()
+			code := s.rcptCode
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "%d whatever\r\n", code)
+		case cmd == "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			text := ""
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				text += line
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, text)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "250 OK\r\n")
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "250 OK\r\n")
+		}
+	}
+}
+
+type bounced struct {
+	sender string
+	text   string
+}
+
+func newQueue(t *testing.T, s *sink) (*Queue, *[]bounced) {
+	q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Resolver = &fakeResolver{"127.0.0.1"}
+	q.Port = s.port()
+	bounces := make([]bounced, 0)
+	q.Notify = func(sender string, text io.Reader) error {
+		data, err := ioutil.ReadAll(text)
+		if err != nil {
+			return err
+		}
+		bounces = append(bounces, bounced{sender, string(data)})
+		return nil
+	}
+	return q, &bounces
+}
+
+func queued(t *testing.T, q *Queue) []string {
+	ids, err := q.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+const msg = "Subject: test\r\n\r\nHello\r\n"
+
+func envelope(from string, to ...string) *Envelope {
+	env := &Envelope{From: from}
+	for _, addr := range to {
+		env.To = append(env.To, &Recipient{Addr: addr})
+	}
+	return env
+}
+
+func TestDelivery(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+
+	err := q.Add(envelope("joe@localhost", "bob@example.net"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+
+	if got := s.received(); len(got) != 1 || got[0] != msg {
+		t.Fatalf("expected the message to be delivered, got %q", got)
+	}
+	if len(queued(t, q)) != 0 {
+		t.Fatal("expected the queue to be empty")
+	}
+	if len(*bounces) != 0 {
+		t.Fatal("unexpected bounce")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+	s.setCode(451)
+
+	err := q.Add(envelope("joe@localhost", "bob@example.net"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	next := q.process(now)
+	if len(queued(t, q)) != 1 {
+		t.Fatal("expected the message to stay in the queue")
+	}
+	if !next.Equal(now.Add(q.Retry)) {
+		t.Fatalf("expected next attempt at %v, got %v", now.Add(q.Retry), next)
+	}
+
+	// Not due yet.
+	s.setCode(250)
+	q.process(now.Add(time.Second))
+	if len(s.received()) != 0 {
+		t.Fatal("expected no delivery before the retry time")
+	}
+
+	q.process(next)
+	if len(s.received()) != 1 {
+		t.Fatal("expected the message to be delivered on retry")
+	}
+	if len(queued(t, q)) != 0 || len(*bounces) != 0 {
+		t.Fatal("expected the queue to be empty and no bounces")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := &Queue{Retry: time.Minute, MaxRetry: 10 * time.Minute}
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, d := range expected {
+		if got := q.backoff(i + 1); got != d {
+			t.Errorf("attempt %d: expected %v, got %v", i+1, d, got)
+		}
+	}
+}
+
+func TestPermanentFailure(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+	s.setCode(550)
+
+	err := q.Add(envelope("joe@localhost", "bob@example.net"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+
+	if len(queued(t, q)) != 0 {
+		t.Fatal("expected the message to be removed from the queue")
+	}
+	if len(*bounces) != 1 || (*bounces)[0].sender != "joe@localhost" {
+		t.Fatalf("expected a bounce to joe@localhost, got %v", *bounces)
+	}
+	if !strings.Contains((*bounces)[0].text, "bob@example.net") {
+		t.Fatal("expected the bounce to mention the recipient")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+	s.setCode(451)
+
+	err := q.Add(envelope("joe@localhost", "bob@example.net"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+	if len(*bounces) != 0 {
+		t.Fatal("unexpected bounce")
+	}
+	q.process(time.Now().Add(q.Expire))
+	if len(queued(t, q)) != 0 {
+		t.Fatal("expected the message to be removed from the queue")
+	}
+	if len(*bounces) != 1 {
+		t.Fatal("expected the message to be bounced")
+	}
+}
+
+func TestNoBounceForEmptySender(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+	s.setCode(550)
+
+	err := q.Add(envelope("", "bob@example.net"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+	if len(queued(t, q)) != 0 || len(*bounces) != 0 {
+		t.Fatal("expected the message to be dropped without a bounce")
+	}
+}
+
+func TestSmarthost(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+	// Exchangers must not be looked up when there's a smarthost.
+	q.Resolver = &fakeResolver{"nonexistent.invalid"}
+	q.Smarthost = &Smarthost{
+		Host: "127.0.0.1",
+		Port: s.port(),
+		TLS:  TLSNone,
+	}
+
+	err := q.Add(envelope("joe@localhost", "bob@example.net", "alice@example.org"), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+
+	if got := s.received(); len(got) != 1 {
+		t.Fatalf("expected one transaction for both recipients, got %d", len(got))
+	}
+	if len(queued(t, q)) != 0 || len(*bounces) != 0 {
+		t.Fatal("expected the queue to be empty and no bounces")
+	}
+}
+
+func TestNotifyParameters(t *testing.T) {
+	s := newSink(t)
+	q, notes := newQueue(t, s)
+
+	env := envelope("joe@localhost", "bob@example.net")
+	env.To[0].Notify = []string{"SUCCESS"}
+	err := q.Add(env, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+	// The sink doesn't support DSN, so the sender is told
+	// that the message has been relayed.
+	if len(*notes) != 1 || !strings.Contains((*notes)[0].text, "Action: relayed") {
+		t.Fatalf("expected a relayed notification, got %v", *notes)
+	}
+
+	s.setCode(550)
+	env = envelope("joe@localhost", "bob@example.net")
+	env.To[0].Notify = []string{"NEVER"}
+	err = q.Add(env, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+	if len(*notes) != 1 {
+		t.Fatal("expected no notification with NOTIFY=NEVER")
+	}
+}
+
+func Test8BitToSevenBitServer(t *testing.T) {
+	s := newSink(t)
+	q, bounces := newQueue(t, s)
+
+	// The sink doesn't support 8BITMIME, so an 8-bit
+	// message can't be sent to it.
+	env := envelope("joe@localhost", "bob@example.net")
+	env.Body = "8BITMIME"
+	err := q.Add(env, strings.NewReader("Subject: café\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.process(time.Now())
+
+	if len(s.received()) != 0 {
+		t.Error("the 8-bit message is sent to a 7-bit server")
+	}
+	if len(queued(t, q)) != 0 {
+		t.Error("expected the message to be removed from the queue")
+	}
+	if len(*bounces) != 1 || !strings.Contains((*bounces)[0].text, "5.6.3") {
+		t.Errorf("expected a bounce with status 5.6.3, got %v", *bounces)
+	}
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"errors"
+	"net/smtp"
+	"strings"
+)
+
+// TLS modes of the smarthost connection.
+const (
+	// Plaintext connection.
+	TLSNone = "none"
+	// Plaintext connection upgraded with STARTTLS, which
+	// is required to succeed.
+	TLSStartTLS = "starttls"
+	// TLS from the first byte.
+	TLSImplicit = "tls"
+
+	// STARTTLS without certificate verification if the server
+	// offers it, plaintext otherwise. Used with exchangers.
+	tlsOpportunistic = "opportunistic"
+)
+
+// Smarthost is a server that all outgoing mail is forwarded
+// through instead of being delivered to the recipient domains'
+// exchangers.
+type Smarthost struct {
+	Host string
+	Port string
+	// One of TLSNone, TLSStartTLS and TLSImplicit.
+	TLS string
+	// Credentials, if the smarthost requires authentication.
+	User     string
+	Password string
+}
+
+// clientAuth picks the best authentication mechanism
+// the server supports.
+func clientAuth(c *smtp.Client, t *target) smtp.Auth {
+	_, params := c.Extension("AUTH")
+	mechs := strings.Fields(strings.ToUpper(params))
+	if hasString(mechs, "CRAM-MD5") {
+		return smtp.CRAMMD5Auth(t.user, t.password)
+	}
+	if !hasString(mechs, "PLAIN") && hasString(mechs, "LOGIN") {
+		return &loginAuth{t.user, t.password}
+	}
+	return smtp.PlainAuth("", t.user, t.password, t.host)
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp
+// doesn't have.
+type loginAuth struct {
+	user     string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like net/smtp's PLAIN, refuse to send the password in the clear.
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.user), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected LOGIN challenge: " + string(fromServer))
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
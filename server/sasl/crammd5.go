@@ -0,0 +1,83 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CRAM-MD5 (RFC 2195): the client replies to the challenge with
+// its name and the HMAC-MD5 of the challenge keyed with the password.
+type cramMD5 struct {
+	backend   Backend
+	challenge []byte
+	user      string
+}
+
+func newCramMD5(b Backend) Server {
+	return &cramMD5{backend: b}
+}
+
+func (m *cramMD5) Next(response []byte) ([]byte, bool, error) {
+	if m.challenge == nil {
+		// The server speaks first in this mechanism.
+		if response != nil {
+			return nil, false, ErrSyntax
+		}
+		challenge, err := newChallenge(hostname(m.backend))
+		if err != nil {
+			return nil, false, err
+		}
+		m.challenge = challenge
+		return challenge, false, nil
+	}
+
+	pos := strings.LastIndex(string(response), " ")
+	if pos < 0 {
+		return nil, false, ErrSyntax
+	}
+	name := string(response[:pos])
+	digest, err := hex.DecodeString(string(response[pos+1:]))
+	if err != nil {
+		return nil, false, ErrSyntax
+	}
+
+	secret, err := m.backend.Secret(name)
+	if err != nil {
+		return nil, false, ErrInvalid
+	}
+	h := hmac.New(md5.New, []byte(secret))
+	h.Write(m.challenge)
+	if !hmac.Equal(h.Sum(nil), digest) {
+		return nil, false, ErrInvalid
+	}
+	m.user = name
+	return nil, true, nil
+}
+
+func (m *cramMD5) User() string {
+	return m.user
+}
+
+// hostname returns the server's name for the challenges.
+func hostname(b Backend) string {
+	if h, ok := b.(HostBackend); ok && h.Hostname() != "" {
+		return h.Hostname()
+	}
+	return "localhost"
+}
+
+// newChallenge returns a unique string in the form of
+// a message identifier, like "<1896.697170952@host>".
+func newChallenge(hostname string) ([]byte, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("<%x.%d@%s>", b, time.Now().Unix(), hostname)), nil
+}
@@ -0,0 +1,39 @@
+package sasl
+
+// LOGIN, which is obsolete but still used by some clients:
+// the server asks for the name and the password in turn.
+type login struct {
+	backend Backend
+	step    int
+	user    string
+}
+
+func newLogin(b Backend) Server {
+	return &login{backend: b}
+}
+
+func (m *login) Next(response []byte) ([]byte, bool, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		// Some clients send the name as the initial response.
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		m.step++
+		m.user = string(response)
+		return []byte("Password:"), false, nil
+	case 2:
+		m.user = string(response)
+		return []byte("Password:"), false, nil
+	default:
+		if m.backend.Verify(m.user, string(response)) != nil {
+			return nil, false, ErrInvalid
+		}
+		return nil, true, nil
+	}
+}
+
+func (m *login) User() string {
+	return m.user
+}
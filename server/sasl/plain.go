@@ -0,0 +1,43 @@
+package sasl
+
+import "bytes"
+
+// PLAIN (RFC 4616): the client sends "authzid\0authcid\0password".
+type plain struct {
+	backend Backend
+	user    string
+	started bool
+}
+
+func newPlain(b Backend) Server {
+	return &plain{backend: b}
+}
+
+func (m *plain) Next(response []byte) ([]byte, bool, error) {
+	// Without the initial response the client is asked
+	// for it with an empty challenge.
+	if response == nil && !m.started {
+		m.started = true
+		return []byte{}, false, nil
+	}
+
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, ErrSyntax
+	}
+	authz, name, password := string(parts[0]), string(parts[1]), string(parts[2])
+
+	// Acting on behalf of other users is not supported.
+	if authz != "" && authz != name {
+		return nil, false, ErrInvalid
+	}
+	if m.backend.Verify(name, password) != nil {
+		return nil, false, ErrInvalid
+	}
+	m.user = name
+	return nil, true, nil
+}
+
+func (m *plain) User() string {
+	return m.user
+}
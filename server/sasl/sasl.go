@@ -0,0 +1,89 @@
+// Package sasl implements the server side of SASL mechanisms
+// (RFC 4422) used by the AUTH commands of SMTP and POP.
+package sasl
+
+import (
+	"errors"
+	"strings"
+)
+
+// Backend checks the credentials given by clients.
+type Backend interface {
+	// Verify returns an error if the password doesn't
+	// belong to the user.
+	Verify(name, password string) error
+	// Secret returns the user's password in plaintext, which is
+	// what challenge-response mechanisms need. Returns ErrNoSecret
+	// if the password is not known in plaintext.
+	Secret(name string) (string, error)
+}
+
+// HostBackend is implemented by backends that know the name of
+// the server. CRAM-MD5 puts it in its challenges, and without it
+// uses "localhost".
+type HostBackend interface {
+	Hostname() string
+}
+
+// Server is the server side of one authentication exchange.
+type Server interface {
+	// Next takes the client's response and returns the next
+	// challenge. The first call gets the initial response, which
+	// is nil if the client hasn't sent it. The exchange is over
+	// when done is true or an error is returned.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// User returns the name of the authenticated user
+	// after a successful exchange.
+	User() string
+}
+
+// Factory creates a server for a new exchange.
+type Factory func(b Backend) Server
+
+var (
+	// ErrInvalid means that the credentials are wrong.
+	ErrInvalid = errors.New("invalid credentials")
+	// ErrSyntax means that the client's response is malformed.
+	ErrSyntax = errors.New("malformed response")
+	// ErrNoSecret is returned by backends that can't give
+	// the plaintext password of a user.
+	ErrNoSecret = errors.New("the password is not available")
+)
+
+type mechanism struct {
+	name string
+	new  Factory
+}
+
+// Mechanisms in the order of registration.
+var mechanisms = []mechanism{
+	{"PLAIN", newPlain},
+	{"LOGIN", newLogin},
+	{"CRAM-MD5", newCramMD5},
+	{"SCRAM-SHA-256", newScram},
+}
+
+// Register adds a mechanism to the list of supported ones.
+func Register(name string, f Factory) {
+	mechanisms = append(mechanisms, mechanism{strings.ToUpper(name), f})
+}
+
+// Names returns names of the supported mechanisms.
+func Names() []string {
+	names := make([]string, 0, len(mechanisms))
+	for _, m := range mechanisms {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// New starts an exchange with the given mechanism. Returns false
+// if the mechanism is not supported.
+func New(name string, b Backend) (Server, bool) {
+	for _, m := range mechanisms {
+		if strings.EqualFold(m.name, name) {
+			return m.new(b), true
+		}
+	}
+	return nil, false
+}
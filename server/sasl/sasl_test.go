@@ -0,0 +1,286 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type users map[string]string
+
+func (u users) Verify(name, password string) error {
+	if p, ok := u[name]; !ok || p != password {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func (u users) Secret(name string) (string, error) {
+	p, ok := u[name]
+	if !ok {
+		return "", ErrNoSecret
+	}
+	return p, nil
+}
+
+var backend = users{"joe": "123"}
+
+// exchange runs the responses through a new server of the
+// mechanism and returns the challenges and the result.
+func exchange(t *testing.T, name string, responses ...[]byte) ([]string, Server, error) {
+	m, ok := New(name, backend)
+	if !ok {
+		t.Fatalf("%s is not supported", name)
+	}
+	challenges := make([]string, 0)
+	for _, r := range responses {
+		c, done, err := m.Next(r)
+		if err != nil || done {
+			return challenges, m, err
+		}
+		challenges = append(challenges, string(c))
+	}
+	t.Fatalf("%s: the exchange is not over", name)
+	return nil, nil, nil
+}
+
+type hostBackend struct {
+	users
+	hostname string
+}
+
+func (b hostBackend) Hostname() string {
+	return b.hostname
+}
+
+func TestPlain(t *testing.T) {
+	_, m, err := exchange(t, "plain", []byte("\x00joe\x00123"))
+	if err != nil || m.User() != "joe" {
+		t.Errorf("initial response: %v, %q", err, m.User())
+	}
+
+	challenges, m, err := exchange(t, "PLAIN", nil, []byte("joe\x00joe\x00123"))
+	if err != nil || m.User() != "joe" || challenges[0] != "" {
+		t.Errorf("two steps: %v, %q, %q", err, m.User(), challenges)
+	}
+
+	cases := map[string]error{
+		"\x00joe\x00124":    ErrInvalid,
+		"bob\x00joe\x00123": ErrInvalid,
+		"joe\x00123":        ErrSyntax,
+		"":                  ErrSyntax,
+	}
+	for response, expected := range cases {
+		_, _, err := exchange(t, "PLAIN", []byte(response))
+		if err != expected {
+			t.Errorf("%q: expected %v, got %v", response, expected, err)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	challenges, m, err := exchange(t, "LOGIN", nil, []byte("joe"), []byte("123"))
+	if err != nil || m.User() != "joe" {
+		t.Errorf("%v, %q", err, m.User())
+	}
+	if fmt.Sprint(challenges) != "[Username: Password:]" {
+		t.Errorf("unexpected challenges: %q", challenges)
+	}
+
+	challenges, _, err = exchange(t, "LOGIN", []byte("joe"), []byte("123"))
+	if err != nil || fmt.Sprint(challenges) != "[Password:]" {
+		t.Errorf("initial response: %v, %q", err, challenges)
+	}
+
+	_, _, err = exchange(t, "LOGIN", nil, []byte("joe"), []byte("124"))
+	if err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestCramMD5(t *testing.T) {
+	m, _ := New("CRAM-MD5", backend)
+	challenge, done, err := m.Next(nil)
+	if err != nil || done {
+		t.Fatal(done, err)
+	}
+	h := hmac.New(md5.New, []byte("123"))
+	h.Write(challenge)
+	_, done, err = m.Next([]byte(fmt.Sprintf("joe %x", h.Sum(nil))))
+	if err != nil || !done || m.User() != "joe" {
+		t.Errorf("%v, %v, %q", done, err, m.User())
+	}
+
+	m, _ = New("CRAM-MD5", hostBackend{backend, "mail.example.net"})
+	challenge, _, _ = m.Next(nil)
+	if !strings.HasSuffix(string(challenge), "@mail.example.net>") {
+		t.Errorf("the challenge doesn't have the configured hostname: %s", challenge)
+	}
+
+	_, _, err = exchange(t, "CRAM-MD5", nil, []byte("joe 0123456789abcdef0123456789abcdef"))
+	if err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+	_, _, err = exchange(t, "CRAM-MD5", []byte("joe"))
+	if err != ErrSyntax {
+		t.Errorf("expected ErrSyntax for an initial response, got %v", err)
+	}
+}
+
+// scramClient computes the client's messages of a SCRAM-SHA-256
+// exchange after the server's first message.
+func scramClient(password, clientFirstBare, serverFirst string) (string, string) {
+	attrs := strings.Split(serverFirst, ",")
+	nonce := attrs[0][2:]
+	salt, _ := base64.StdEncoding.DecodeString(attrs[1][2:])
+	iterations, _ := strconv.Atoi(attrs[2][2:])
+	creds := deriveScram(password, salt, iterations)
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	signature := hmacSHA256(creds.StoredKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	final := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	verifier := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(creds.ServerKey, authMessage))
+	return final, verifier
+}
+
+func TestScram(t *testing.T) {
+	stored, err := NewScramCredentials("pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := scramUsers{"user": stored}
+
+	for _, password := range []string{"pencil", "pen"} {
+		m, _ := New("SCRAM-SHA-256", b)
+		first := "n=user,r=rOprNGfwEbeRWgbNEkqO"
+		serverFirst, _, err := m.Next([]byte("n,," + first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(serverFirst), "r=rOprNGfwEbeRWgbNEkqO") {
+			t.Fatalf("unexpected server-first message: %s", serverFirst)
+		}
+		final, verifier := scramClient(password, first, string(serverFirst))
+		serverFinal, done, err := m.Next([]byte(final))
+		if password != "pencil" {
+			if err != ErrInvalid {
+				t.Errorf("expected ErrInvalid for a wrong password, got %v", err)
+			}
+			continue
+		}
+		if err != nil || done || string(serverFinal) != verifier {
+			t.Fatalf("%q, %v, %v", serverFinal, done, err)
+		}
+		_, done, err = m.Next([]byte{})
+		if err != nil || !done || m.User() != "user" {
+			t.Errorf("%v, %v, %q", done, err, m.User())
+		}
+	}
+}
+
+func TestScramUnknownUser(t *testing.T) {
+	b := scramUsers{}
+	first := "n=nobody,r=rOprNGfwEbeRWgbNEkqO"
+
+	// An unknown user gets a server-first message like any
+	// other, with the same salt every time.
+	salts := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		m, _ := New("SCRAM-SHA-256", b)
+		serverFirst, _, err := m.Next([]byte("n,," + first))
+		if err != nil {
+			t.Fatalf("unexpected error for an unknown user: %v", err)
+		}
+		salts = append(salts, strings.Split(string(serverFirst), ",")[1])
+
+		// And fails at the end, like a wrong password.
+		final, _ := scramClient("pencil", first, string(serverFirst))
+		_, _, err = m.Next([]byte(final))
+		if err != ErrInvalid {
+			t.Errorf("expected ErrInvalid, got %v", err)
+		}
+	}
+	if salts[0] != salts[1] {
+		t.Errorf("the salt changes: %s, %s", salts[0], salts[1])
+	}
+}
+
+func TestScramPlaintextUser(t *testing.T) {
+	first := "n=joe,r=rOprNGfwEbeRWgbNEkqO"
+
+	// Credentials made from a plaintext password have the same
+	// salt every time too.
+	salts := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		m, _ := New("SCRAM-SHA-256", backend)
+		serverFirst, _, err := m.Next([]byte("n,," + first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		salts = append(salts, strings.Split(string(serverFirst), ",")[1])
+
+		final, verifier := scramClient("123", first, string(serverFirst))
+		serverFinal, _, err := m.Next([]byte(final))
+		if err != nil || string(serverFinal) != verifier {
+			t.Errorf("%q, %v", serverFinal, err)
+		}
+	}
+	if salts[0] != salts[1] {
+		t.Errorf("the salt changes: %s, %s", salts[0], salts[1])
+	}
+}
+
+func TestScramCredentials(t *testing.T) {
+	c, err := NewScramCredentials("pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseScramCredentials(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != c.String() {
+		t.Errorf("%s != %s", parsed, c)
+	}
+	if !parsed.Check("pencil") || parsed.Check("pen") {
+		t.Error("Check doesn't work")
+	}
+
+	// The example from RFC 5803, but with SHA-256 keys.
+	_, err = ParseScramCredentials("SCRAM-SHA-256$4096:QSXCR+Q6sek8bf92$HZbuOlKbWl+eR8AfIposuKbhX30=:HZbuOlKbWl+eR8AfIposuKbhX30=")
+	if err == nil {
+		t.Error("expected an error for keys of wrong length")
+	}
+}
+
+type scramUsers map[string]*ScramCredentials
+
+func (u scramUsers) Verify(name, password string) error {
+	return ErrInvalid
+}
+
+func (u scramUsers) Secret(name string) (string, error) {
+	return "", ErrNoSecret
+}
+
+func (u scramUsers) ScramCredentials(name string) (*ScramCredentials, error) {
+	c, ok := u[name]
+	if !ok {
+		return nil, ErrInvalid
+	}
+	return c, nil
+}
@@ -0,0 +1,325 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ScramPrefix starts SCRAM-SHA-256 credentials written as strings.
+const ScramPrefix = "SCRAM-SHA-256$"
+
+// Iteration count for new SCRAM credentials.
+const scramIterations = 4096
+
+// Key for the salts made from user names.
+var saltKey = func() []byte {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// ScramCredentials is what the server keeps to authenticate users
+// with SCRAM-SHA-256 (RFC 5802, RFC 7677). The password can't be
+// recovered from it, nor can it be used to log in.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// ScramBackend is implemented by backends that keep SCRAM
+// credentials. For other backends SCRAM works only with users
+// whose passwords are available through Secret.
+type ScramBackend interface {
+	// ScramCredentials returns the user's credentials or
+	// ErrNoSecret if the user doesn't have them.
+	ScramCredentials(name string) (*ScramCredentials, error)
+}
+
+// NewScramCredentials derives credentials from the password
+// with a random salt.
+func NewScramCredentials(password string) (*ScramCredentials, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return deriveScram(password, salt, scramIterations), nil
+}
+
+func deriveScram(password string, salt []byte, iterations int) *ScramCredentials {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, "Server Key"),
+	}
+}
+
+// Check returns true if the credentials were derived
+// from the given password.
+func (c *ScramCredentials) Check(password string) bool {
+	d := deriveScram(password, c.Salt, c.Iterations)
+	return hmac.Equal(d.StoredKey, c.StoredKey) && hmac.Equal(d.ServerKey, c.ServerKey)
+}
+
+// String returns the credentials in the form accepted by
+// ParseScramCredentials:
+// "SCRAM-SHA-256$<iterations>:<salt>$<stored key>:<server key>",
+// with the binary values in base64 (RFC 5803).
+func (c *ScramCredentials) String() string {
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%s%d:%s$%s:%s", ScramPrefix, c.Iterations, b64(c.Salt), b64(c.StoredKey), b64(c.ServerKey))
+}
+
+// ParseScramCredentials parses credentials written by String.
+func ParseScramCredentials(s string) (*ScramCredentials, error) {
+	malformed := errors.New("malformed SCRAM credentials")
+	if !strings.HasPrefix(s, ScramPrefix) {
+		return nil, malformed
+	}
+	parts := strings.Split(s[len(ScramPrefix):], "$")
+	if len(parts) != 2 {
+		return nil, malformed
+	}
+	salt := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(salt) != 2 || len(keys) != 2 {
+		return nil, malformed
+	}
+
+	c := new(ScramCredentials)
+	var err error
+	c.Iterations, err = strconv.Atoi(salt[0])
+	if err != nil || c.Iterations <= 0 {
+		return nil, malformed
+	}
+	b64 := base64.StdEncoding.DecodeString
+	c.Salt, err = b64(salt[1])
+	if err != nil {
+		return nil, malformed
+	}
+	c.StoredKey, err = b64(keys[0])
+	if err != nil {
+		return nil, malformed
+	}
+	c.ServerKey, err = b64(keys[1])
+	if err != nil {
+		return nil, malformed
+	}
+	if len(c.StoredKey) != sha256.Size || len(c.ServerKey) != sha256.Size {
+		return nil, malformed
+	}
+	return c, nil
+}
+
+// SCRAM-SHA-256 without channel binding.
+type scram struct {
+	backend Backend
+	step    int
+	name    string
+	user    string
+	creds   *ScramCredentials
+	// The user is unknown and the credentials are made up.
+	fake bool
+	// Parts of the exchange the proofs are computed from.
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	// The final message, sent with the success.
+	serverFinal []byte
+}
+
+func newScram(b Backend) Server {
+	return &scram{backend: b}
+}
+
+func (m *scram) Next(response []byte) ([]byte, bool, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		// The client speaks first.
+		if response == nil {
+			m.step--
+			return []byte{}, false, nil
+		}
+		return m.first(string(response))
+	case 2:
+		return m.final(string(response))
+	default:
+		// The client has acknowledged the server's signature.
+		if len(response) != 0 {
+			return nil, false, ErrSyntax
+		}
+		return nil, true, nil
+	}
+}
+
+// first takes "n,[a=<authzid>],n=<name>,r=<nonce>[,...]".
+func (m *scram) first(msg string) ([]byte, bool, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrSyntax
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, false, errors.New("channel binding is not supported")
+	default:
+		return nil, false, ErrSyntax
+	}
+	m.gs2Header = parts[0] + "," + parts[1] + ","
+	m.clientFirstBare = parts[2]
+
+	attrs := strings.Split(m.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, ErrSyntax
+	}
+	name, err := decodeScramName(attrs[0][2:])
+	if err != nil {
+		return nil, false, err
+	}
+	if parts[1] != "" && parts[1] != "a="+attrs[0][2:] {
+		// Acting on behalf of other users is not supported.
+		return nil, false, ErrInvalid
+	}
+	clientNonce := attrs[1][2:]
+	if clientNonce == "" {
+		return nil, false, ErrSyntax
+	}
+	m.name = name
+
+	m.creds, err = m.credentials(name)
+	if err != nil {
+		// Going on with made-up credentials, so that unknown
+		// users can't be told apart from wrong passwords.
+		m.creds = fakeScram(name)
+		m.fake = true
+	}
+
+	b := make([]byte, 18)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, false, err
+	}
+	m.nonce = clientNonce + base64.StdEncoding.EncodeToString(b)
+	m.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", m.nonce, base64.StdEncoding.EncodeToString(m.creds.Salt), m.creds.Iterations)
+	return []byte(m.serverFirst), false, nil
+}
+
+// final takes "c=<channel binding>,r=<nonce>[,...],p=<proof>".
+func (m *scram) final(msg string) ([]byte, bool, error) {
+	pos := strings.LastIndex(msg, ",p=")
+	if pos < 0 {
+		return nil, false, ErrSyntax
+	}
+	withoutProof := msg[:pos]
+	proof, err := base64.StdEncoding.DecodeString(msg[pos+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, ErrSyntax
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, ErrSyntax
+	}
+	if attrs[0][2:] != base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) || attrs[1][2:] != m.nonce {
+		return nil, false, ErrInvalid
+	}
+
+	authMessage := m.clientFirstBare + "," + m.serverFirst + "," + withoutProof
+	signature := hmacSHA256(m.creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], m.creds.StoredKey) || m.fake {
+		return nil, false, ErrInvalid
+	}
+	m.user = m.name
+
+	serverSignature := hmacSHA256(m.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
+
+// credentials returns the stored credentials of the user, or
+// derives them from the plaintext password if there are none.
+func (m *scram) credentials(name string) (*ScramCredentials, error) {
+	if b, ok := m.backend.(ScramBackend); ok {
+		creds, err := b.ScramCredentials(name)
+		if err != ErrNoSecret {
+			return creds, err
+		}
+	}
+	password, err := m.backend.Secret(name)
+	if err != nil {
+		return nil, err
+	}
+	// The salt must not change between attempts, or it would
+	// tell these users from the unknown ones.
+	return deriveScram(password, nameSalt(name), scramIterations), nil
+}
+
+// fakeScram makes up credentials for an unknown user.
+func fakeScram(name string) *ScramCredentials {
+	return &ScramCredentials{
+		Salt:       nameSalt(name),
+		Iterations: scramIterations,
+		StoredKey:  hmacSHA256(saltKey, "stored key:"+name),
+		ServerKey:  hmacSHA256(saltKey, "server key:"+name),
+	}
+}
+
+// nameSalt returns a salt that depends only on the user name, so
+// that it's the same on every attempt, like a stored salt would be.
+func nameSalt(name string) []byte {
+	return hmacSHA256(saltKey, "salt:"+name)[:16]
+}
+
+func (m *scram) User() string {
+	return m.user
+}
+
+// decodeScramName decodes the "=2C" and "=3D" escapes.
+func decodeScramName(s string) (string, error) {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", ErrSyntax
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
@@ -1,19 +1,26 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/gaswelder/ring2/server/mailbox"
 	"github.com/gaswelder/ring2/server/pop"
+	"github.com/gaswelder/ring2/server/queue"
 	"github.com/gaswelder/ring2/server/smtp"
 )
 
 type Server struct {
-	config *Config
+	config    *Config
+	tls       *tls.Config
+	queue     *queue.Queue
+	listeners []net.Listener
 }
 
 func New(config *Config) *Server {
@@ -22,14 +29,62 @@ func New(config *Config) *Server {
 	}
 }
 
-func (s *Server) Run() {
+// Run binds all configured listeners and starts serving them
+// in the background.
+func (s *Server) Run() error {
 	err := createDir(s.config.Maildir)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	err = createDir(s.config.tempDir())
+	if err != nil {
+		return err
+	}
+
+	if s.config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+		if err != nil {
+			return err
+		}
+		s.tls = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
 	}
 
-	go runSMTP(s.config)
-	go runPOP(s.config)
+	q, err := queue.New(s.config.Maildir + "/.queue")
+	if err != nil {
+		return err
+	}
+	q.Hostname = s.config.Hostname
+	q.Smarthost = s.config.Relay
+	q.Notify = notify(s.config, q)
+	s.queue = q
+	go q.Run()
+
+	for _, l := range s.config.Listeners {
+		ln, err := s.listen(l)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+		log.Printf("%s: listening on %s\n", l.Name(), l.Addr)
+		go serve(ln, s.config.Debug, s.handler(l))
+	}
+	return nil
+}
+
+// Close stops all listeners and the delivery queue.
+// Sessions that are already running are not interrupted.
+func (s *Server) Close() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.listeners = nil
+	if s.queue != nil {
+		s.queue.Close()
+		s.queue = nil
+	}
 }
 
 func createDir(path string) error {
@@ -40,102 +95,201 @@ func createDir(path string) error {
 	return os.MkdirAll(path, 0755)
 }
 
-func auth(config *Config) pop.AuthFunc {
-	return func(name, password string) (*mailbox.Mailbox, error) {
-		user := config.findUser(name, password)
+func popHandler(config *Config, tlsConfig *tls.Config, l Listener) handler {
+	open := func(name string) (*mailbox.Mailbox, error) {
+		user := config.user(name)
 		if user == nil {
-			return nil, errors.New("invalid credentials")
+			return nil, errors.New("unknown user")
 		}
 		return config.mailbox(user)
 	}
+	c := &pop.Config{
+		Auth:     &backend{config},
+		Open:     open,
+		Hostname: config.Hostname,
+		TLS:      l.TLS,
+	}
+	return func(conn *session) {
+		pop.Process(conn.stream(), c, conn.starttls(tlsConfig))
+	}
 }
 
-func runPOP(config *Config) error {
-	ln, err := net.Listen("tcp", config.Pop)
-	if err != nil {
-		return err
+func smtpHandler(config *Config, tlsConfig *tls.Config, q *queue.Queue, l Listener) handler {
+	getbox := func(addr *smtp.Address) ([]*mailbox.Mailbox, error) {
+		if !config.isLocal(addr.Host) {
+			return nil, smtp.ErrNotLocal
+		}
+		return config.boxes(addr.Name, addr.Host)
 	}
-	log.Printf("POP: listening on %s\n", config.Pop)
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
+
+	// VRFY and EXPN arguments without a domain
+	// are in the main one.
+	domain := func(addr *smtp.Address) (*Domain, error) {
+		if addr.Host == "" {
+			return config.domain(config.Hostname), nil
+		}
+		d := config.domain(addr.Host)
+		if d == nil {
+			return nil, smtp.ErrNotLocal
+		}
+		return d, nil
+	}
+
+	verify := func(addr *smtp.Address) (*smtp.Address, error) {
+		d, err := domain(addr)
 		if err != nil {
-			log.Println(err)
-			continue
+			return nil, err
 		}
-		log.Printf("%s connected\n", conn.RemoteAddr().String())
-		var rw io.ReadWriter = conn
-		if config.Debug {
-			rw = &tap{rw}
+		if _, ok := d.Users[addr.Name]; !ok {
+			return nil, errors.New("unknown user")
 		}
-		go func() {
-			pop.Process(rw, auth(config))
-			conn.Close()
-			log.Printf("%s disconnected\n", conn.RemoteAddr().String())
-		}()
+		return &smtp.Address{Name: addr.Name, Host: d.Name}, nil
 	}
-}
 
-func runSMTP(config *Config) error {
-	ln, err := net.Listen("tcp", config.Smtp)
-	if err != nil {
-		return err
+	expand := func(addr *smtp.Address) ([]*smtp.Address, error) {
+		d, err := domain(addr)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := d.Lists[addr.Name]
+		if !ok {
+			return nil, errors.New("unknown list")
+		}
+		members := make([]*smtp.Address, 0, len(list))
+		for _, user := range list {
+			members = append(members, &smtp.Address{Name: user.Name, Host: d.Name})
+		}
+		return members, nil
 	}
-	log.Printf("SMTP: listening on %s\n", config.Smtp)
-	defer ln.Close()
 
-	auth := func(name, password string) error {
-		u := config.findUser(name, password)
-		if u != nil {
-			return nil
+	var sender smtp.SenderFunc
+	if config.CheckSender {
+		sender = func(login string, addr *smtp.Address) bool {
+			user := config.user(login)
+			return user != nil && config.isSender(user, addr.Name, addr.Host)
 		}
-		return errors.New("Invalid authorization data")
 	}
 
-	getbox := func(name string) ([]*mailbox.Mailbox, error) {
-		boxes := make([]*mailbox.Mailbox, 0)
+	c := &smtp.Config{
+		Auth:        &backend{config},
+		Lookup:      getbox,
+		Notify:      notify(config, q),
+		Hostname:    config.Hostname,
+		Domains:     config.localDomains(),
+		MaxSize:     config.MaxSize,
+		TempDir:     config.tempDir(),
+		Verify:      verify,
+		Expand:      expand,
+		VerifyAnon:  config.VerifyAnon,
+		CheckSender: sender,
+		RequireAuth: l.RequireAuth,
+		RequireTLS:  l.RequireTLS,
+		TLS:         l.TLS,
+	}
+	if l.Relay {
+		c.Relay = relay(q)
+	}
+	return func(conn *session) {
+		smtp.Process(conn.stream(), c, conn.starttls(tlsConfig))
+	}
+}
 
-		list, _ := config.Lists[name]
-		if list != nil {
-			for _, user := range list {
-				box, err := config.mailbox(user)
-				if err != nil {
-					return nil, err
-				}
-				boxes = append(boxes, box)
+// relay puts messages from SMTP sessions into the queue.
+func relay(q *queue.Queue) smtp.RelayFunc {
+	return func(m *smtp.Mail, to []*smtp.Recipient, text io.Reader) error {
+		env := &queue.Envelope{
+			From:  m.Sender.Addr.Format(),
+			EnvID: m.EnvID,
+			Ret:   m.Ret,
+			Body:  m.Body,
+			UTF8:  m.UTF8,
+		}
+		for _, r := range to {
+			env.To = append(env.To, &queue.Recipient{
+				Addr:   r.Path.Addr.Format(),
+				Notify: r.Notify,
+				ORCPT:  r.ORCPT,
+			})
+		}
+		return q.Add(env, text)
+	}
+}
+
+// notify delivers a delivery status notification to the sender.
+func notify(config *Config, q *queue.Queue) func(sender string, text io.Reader) error {
+	return func(sender string, text io.Reader) error {
+		pos := strings.LastIndex(sender, "@")
+		if pos < 0 || !config.isLocal(sender[pos+1:]) {
+			// Notifications are sent with empty sender so that
+			// they never cause notifications themselves.
+			env := &queue.Envelope{
+				To: []*queue.Recipient{{Addr: sender}},
 			}
-			return boxes, nil
+			return q.Add(env, text)
+		}
+		boxes, err := config.boxes(sender[:pos], sender[pos+1:])
+		if err != nil {
+			return err
+		}
+		if len(boxes) == 1 {
+			return boxes[0].Add(text)
 		}
 
-		user, ok := config.Users[name]
-		if ok {
-			box, err := config.mailbox(user)
+		// The text can be read only once, so for a list it's
+		// kept in a file.
+		f, err := ioutil.TempFile(config.tempDir(), "notify-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := io.Copy(f, text)
+		if err != nil {
+			return err
+		}
+		for _, box := range boxes {
+			err := box.Add(io.NewSectionReader(f, 0, size))
 			if err != nil {
-				return nil, err
+				return err
 			}
-			boxes = append(boxes, box)
-			return boxes, nil
-
 		}
-		return nil, errors.New("unknown recipient")
+		return nil
+	}
+}
+
+// session is an accepted connection that may be switched
+// to TLS in the middle of a protocol session.
+type session struct {
+	net.Conn
+	debug bool
+}
+
+// stream returns the stream the protocol session should talk over.
+func (c *session) stream() io.ReadWriter {
+	if c.debug {
+		return &tap{c.Conn}
 	}
+	return c.Conn
+}
 
-	for {
-		conn, err := ln.Accept()
+// starttls returns a function that upgrades the connection to TLS.
+// If there is no TLS configuration or the connection is already
+// encrypted, returns nil.
+func (c *session) starttls(config *tls.Config) func() (io.ReadWriter, error) {
+	if config == nil {
+		return nil
+	}
+	if _, ok := c.Conn.(*tls.Conn); ok {
+		return nil
+	}
+	return func() (io.ReadWriter, error) {
+		conn := tls.Server(c.Conn, config)
+		err := conn.Handshake()
 		if err != nil {
-			log.Println(err)
-			continue
-		}
-		log.Printf("%s connected\n", conn.RemoteAddr().String())
-		var rw io.ReadWriter = conn
-		if config.Debug {
-			rw = &tap{rw}
-		}
-		go func() {
-			smtp.Process(rw, auth, getbox)
-			conn.Close()
-			log.Printf("%s disconnected\n", conn.RemoteAddr().String())
-		}()
+			return nil, err
+		}
+		c.Conn = conn
+		return c.stream(), nil
 	}
 }
 
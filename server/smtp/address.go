@@ -3,6 +3,8 @@ package smtp
 import (
 	"errors"
 	"strings"
+
+	"github.com/gaswelder/ring2/scanner"
 )
 
 type Address struct {
@@ -10,16 +12,71 @@ type Address struct {
 	Host string
 }
 
+// Format returns the address as it's written in paths, with the
+// local part quoted if needed. The null address gives an empty string.
 func (a *Address) Format() string {
-	return a.Name + "@" + a.Host
+	if a.Host == "" {
+		return ""
+	}
+	return formatLocalPart(a.Name) + "@" + a.Host
+}
+
+// ASCII returns false if the address needs SMTPUTF8 to be
+// transferred (RFC 6531).
+func (a *Address) ASCII() bool {
+	for i := 0; i < len(a.Name); i++ {
+		if a.Name[i] >= 0x80 {
+			return false
+		}
+	}
+	for i := 0; i < len(a.Host); i++ {
+		if a.Host[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
 }
 
 func parseAddress(addr string) (*Address, error) {
-	pos := strings.Index(addr, "@")
-	if pos < 0 {
+	r := scanner.New(addr)
+	a, err := readMailbox(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.More() {
 		return nil, errors.New("Invalid email address")
 	}
-	name := addr[:pos]
-	host := addr[pos+1:]
-	return &Address{name, host}, nil
+	return a, nil
+}
+
+// formatLocalPart returns the local part as a dot-string if it
+// is one, or as a quoted string.
+func formatLocalPart(name string) string {
+	if isDotString(name) {
+		return name
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(name); i++ {
+		if name[i] == '"' || name[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(name[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isDotString(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if !isAtext(atom[i]) {
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -32,7 +32,9 @@ func parseCommand(line string) (*Command, error) {
 	if r.Next() == ' ' {
 		r.Get()
 		for r.More() && r.Next() != '\r' {
-			arg += string(r.Get())
+			// Bytes are added as they are, so that UTF-8
+			// addresses pass through.
+			arg += string([]byte{r.Get()})
 		}
 	}
 
@@ -0,0 +1,112 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// dataReader reads the message text that follows the DATA command,
+// removing the dot-stuffing. It returns io.EOF at the line with
+// a single dot.
+type dataReader struct {
+	r *bufio.Reader
+	// Unread part of the current line.
+	buf []byte
+	// Whether the next read starts a new line.
+	lineStart bool
+	done      bool
+}
+
+func newDataReader(r *bufio.Reader) *dataReader {
+	return &dataReader{r: r, lineStart: true}
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		err := d.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// fill reads the next piece of input into the buffer. Long lines
+// are read in pieces, so that memory use doesn't depend on them.
+func (d *dataReader) fill() error {
+	line, err := d.r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if d.lineStart {
+		if string(line) == ".\r\n" {
+			d.done = true
+			return nil
+		}
+		/*
+		 * If the line starts with a dot and there are other
+		 * characters, remove the dot.
+		 */
+		if len(line) > 0 && line[0] == '.' {
+			line = line[1:]
+		}
+	}
+	d.lineStart = err == nil
+	d.buf = append(d.buf[:0], line...)
+	return nil
+}
+
+var errTooBig = errors.New("message is too big")
+
+// copyLimited copies from r to w until EOF. If the size limit is
+// not zero and the data exceeds it, returns errTooBig.
+func copyLimited(w io.Writer, r io.Reader, limit int64) (int64, error) {
+	if limit == 0 {
+		return io.Copy(w, r)
+	}
+	n, err := io.Copy(w, io.LimitReader(r, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, errTooBig
+	}
+	return n, nil
+}
+
+// newSpool creates a temporary file to keep an incoming message.
+func (s *session) newSpool() (*os.File, error) {
+	return ioutil.TempFile(s.config.TempDir, "smtp-")
+}
+
+// spoolWriter writes the message to a spool file. If writing fails,
+// the error is kept and the rest of the data is discarded, so that
+// the client's input is still read to the end and errors of reading
+// it can be told apart from errors of writing the spool.
+type spoolWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
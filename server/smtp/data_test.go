@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDataReader(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	input := "Subject: hi\r\n\r\n..dot\r\n" + long + "\r\n.\r\nQUIT\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	data, err := ioutil.ReadAll(newDataReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Subject: hi\r\n\r\n.dot\r\n" + long + "\r\n"
+	if string(data) != expected {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	// The rest of the input is left for the commands.
+	rest, _ := r.ReadString('\n')
+	if rest != "QUIT\r\n" {
+		t.Errorf("unexpected rest: %q", rest)
+	}
+}
+
+func TestDataReaderEOF(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("Subject: hi\r\n"))
+	_, err := ioutil.ReadAll(newDataReader(r))
+	if err == nil {
+		t.Error("expected an error for a message without the end")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestSpoolWriterError(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("Subject: hi\r\n\r\nHello\r\n.\r\nQUIT\r\n"))
+	w := &spoolWriter{w: failingWriter{}}
+	_, err := copyLimited(w, newDataReader(r), 0)
+	if err != nil {
+		t.Errorf("unexpected read error: %v", err)
+	}
+	if w.err == nil {
+		t.Error("the write error is lost")
+	}
+
+	// The message is read to the end anyway.
+	rest, _ := r.ReadString('\n')
+	if rest != "QUIT\r\n" {
+		t.Errorf("unexpected rest: %q", rest)
+	}
+}
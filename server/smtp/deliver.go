@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gaswelder/ring2/server/dsn"
+	"github.com/gaswelder/ring2/server/mailbox"
+)
+
+// localRecipient is an accepted recipient along with the
+// mailboxes it resolves to.
+type localRecipient struct {
+	*Recipient
+	boxes []*mailbox.Mailbox
+}
+
+// status returns a delivery status report entry for the recipient.
+func (r *Recipient) status(action, code, reason string) *dsn.Recipient {
+	return &dsn.Recipient{
+		Original: r.ORCPT,
+		Final:    r.Path.Addr.Format(),
+		Action:   action,
+		Status:   code,
+		Reason:   reason,
+	}
+}
+
+// deliver passes the message kept in the spool file to the
+// recipients of the current transaction and replies to the client.
+func (s *session) deliver(spool *os.File, size int64) {
+	/*
+	 * Insert a stamp at the beginning of the message
+	 * Example: Received: from GHI.ARPA by JKL.ARPA ; 27 Oct 81 15:27:39 PST
+	 */
+	receivedLine := fmt.Sprintf("Received: from %s by %s ; %s\r\n",
+		s.senderHost, s.config.Hostname, time.Now().Format(time.RFC822))
+
+	// Every delivery reads the spool from the start.
+	text := func() io.Reader {
+		return io.MultiReader(strings.NewReader(receivedLine), io.NewSectionReader(spool, 0, size))
+	}
+
+	/*
+	 * Queue the message for remote recipients. The Return-Path
+	 * line is added only on the final delivery.
+	 */
+	if len(s.relayTo) > 0 {
+		err := s.config.Relay(s.draft, s.relayTo, text())
+		if err != nil {
+			log.Printf("failed to queue the message: %s", err.Error())
+			s.Reply(&Reply{451, "4.3.0", "Couldn't queue the message"})
+			return
+		}
+	}
+
+	/*
+	 * Deliver to each local recipient separately, so that failures
+	 * of some of them don't affect the others. If no one got the
+	 * message, the client is told so. Otherwise the message is
+	 * accepted and the sender gets the notifications they asked for.
+	 */
+	rpathLine := fmt.Sprintf("Return-Path: %s\r\n", s.draft.Sender.Format())
+	statuses, failed := s.deliverLocal(func() io.Reader {
+		return io.MultiReader(strings.NewReader(rpathLine), text())
+	})
+	if failed == len(s.recipients) && failed > 0 && len(s.relayTo) == 0 {
+		s.reset()
+		s.Reply(&Reply{554, "5.3.0", "Couldn't deliver the message"})
+		return
+	}
+	s.notify(statuses, text())
+	s.reset()
+	s.Reply(replyOK)
+}
+
+// deliverLocal puts the message into the local recipients' mailboxes.
+// Returns delivery statuses for all recipients and the number of
+// recipients that didn't get the message. A list that some of its
+// members didn't get is reported as failed, but counts as failed
+// only if none of its members got the message.
+func (s *session) deliverLocal(text func() io.Reader) ([]*dsn.Recipient, int) {
+	statuses := make([]*dsn.Recipient, 0, len(s.recipients))
+	failed := 0
+	for _, r := range s.recipients {
+		// A failed mailbox of a list doesn't stop
+		// the delivery to the other members.
+		delivered := 0
+		for _, box := range r.boxes {
+			err := box.Add(text())
+			if err != nil {
+				log.Printf("couldn't deliver to %s: %s", box.Name(), err.Error())
+				continue
+			}
+			delivered++
+		}
+		switch {
+		case delivered == 0 && len(r.boxes) > 0:
+			failed++
+			statuses = append(statuses, r.status(dsn.Failed, "5.2.0", "Couldn't write to the mailbox"))
+		case delivered < len(r.boxes):
+			statuses = append(statuses, r.status(dsn.Failed, "5.2.0",
+				fmt.Sprintf("Couldn't write to the mailboxes of %d of %d list members", len(r.boxes)-delivered, len(r.boxes))))
+		case len(r.boxes) == 1:
+			statuses = append(statuses, r.status(dsn.Delivered, "2.0.0", ""))
+		default:
+			// A mailing list
+			statuses = append(statuses, r.status(dsn.Expanded, "2.0.0", ""))
+		}
+	}
+	return statuses, failed
+}
+
+// notify sends the sender notifications they asked for
+// about the given recipients.
+func (s *session) notify(statuses []*dsn.Recipient, text io.Reader) {
+	// Messages with empty reverse-path are notifications
+	// themselves and must not be answered.
+	if s.config.Notify == nil || s.draft.Sender.Null() {
+		return
+	}
+
+	report := &dsn.Report{
+		ReportingMTA: s.config.Hostname,
+		To:           s.draft.Sender.Addr.Format(),
+		Arrival:      time.Now(),
+		Original:     text,
+		HeadersOnly:  s.draft.Ret == dsn.RetHdrs,
+		EnvID:        s.draft.EnvID,
+	}
+	for i, r := range s.recipients {
+		if dsn.Requested(r.Notify, statuses[i].Action) {
+			report.Recipients = append(report.Recipients, statuses[i])
+		}
+	}
+	if len(report.Recipients) == 0 {
+		return
+	}
+	err := s.config.Notify(report.To, report.Reader())
+	if err != nil {
+		log.Printf("couldn't send a notification to %s: %s", report.To, err.Error())
+	}
+}
@@ -1,26 +1,22 @@
 package smtp
 
 import (
-	"time"
+	"sort"
+	"strings"
 )
 
-var helpInit = false
-var helpSeed int
+// helpText lists the supported commands. It's filled in init
+// because the command tables refer to cmdHelp themselves.
+var helpText string
 
-var helpMessages = []string{
-	"Nah, go RTFM",
-	"Sorry, I'm busy right now",
-	"Error: not a psychiatrist",
-	"Usage: HELP",
-	"Unknown command: HELP. Try HELP for more info",
-	"Face not recognized",
-	"Maybe, take a vacation?",
-}
-
-func helpfulMessage() string {
-	if !helpInit {
-		helpInit = true
-		helpSeed = time.Now().Second()
+func init() {
+	names := []string{"QUIT"}
+	for name := range commands {
+		names = append(names, name)
+	}
+	for name := range smtpExts {
+		names = append(names, name)
 	}
-	return helpMessages[helpSeed%len(helpMessages)]
+	sort.Strings(names)
+	helpText = "Supported commands: " + strings.Join(names, " ")
 }
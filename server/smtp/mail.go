@@ -5,12 +5,32 @@ package smtp
  */
 type Mail struct {
 	Sender     *Path
-	Recipients []*Path
+	Recipients []*Recipient
+	// Envelope identifier from the ENVID parameter, decoded.
+	EnvID string
+	// RET parameter: what part of the message to return in
+	// notifications, "FULL", "HDRS" or empty if not specified.
+	Ret string
+	// BODY parameter: "7BIT", "8BITMIME" or empty if not specified.
+	Body string
+	// Set if the client gave the SMTPUTF8 parameter, which allows
+	// UTF-8 in the addresses and the headers (RFC 6531).
+	UTF8 bool
+}
+
+// Recipient is a forward-path with its parameters.
+type Recipient struct {
+	Path *Path
+	// Values of the NOTIFY parameter, empty if not specified.
+	Notify []string
+	// The original recipient from the ORCPT parameter, decoded,
+	// like "rfc822;bob@example.net".
+	ORCPT string
 }
 
 func NewDraft(from *Path) *Mail {
 	return &Mail{
-		from,
-		make([]*Path, 0),
+		Sender:     from,
+		Recipients: make([]*Recipient, 0),
 	}
 }
@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gaswelder/ring2/server/dsn"
+)
+
+const MessageTooBig = 552
+const ParameterNotRecognized = 555
+
+// parseParams parses the "<key>[=<value>]" list that may follow
+// the path in MAIL and RCPT commands. Keys are returned in upper case.
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Fields(s) {
+		key := param
+		val := ""
+		pos := strings.Index(param, "=")
+		if pos >= 0 {
+			key = param[:pos]
+			val = param[pos+1:]
+		}
+		key = strings.ToUpper(key)
+		if key == "" {
+			return nil, fmt.Errorf("Malformed parameter: %s", param)
+		}
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("Duplicate parameter: %s", key)
+		}
+		params[key] = val
+	}
+	return params, nil
+}
+
+// mailParams applies parameters of the MAIL command to the draft.
+func (s *session) mailParams(m *Mail, params map[string]string) *Reply {
+	for key, val := range params {
+		switch key {
+		case "SIZE":
+			size, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || size < 0 {
+				return &Reply{ParameterSyntaxError, "5.5.4", "Invalid SIZE value"}
+			}
+			if s.tooBig(size) {
+				return errTooBigMessage
+			}
+		case "ENVID":
+			envid, err := dsn.DecodeXtext(val)
+			if err != nil || envid == "" || len(val) > 100 {
+				return &Reply{ParameterSyntaxError, "5.5.4", "Invalid ENVID value"}
+			}
+			m.EnvID = envid
+		case "RET":
+			val = strings.ToUpper(val)
+			if val != dsn.RetFull && val != dsn.RetHdrs {
+				return &Reply{ParameterSyntaxError, "5.5.4", "RET must be FULL or HDRS"}
+			}
+			m.Ret = val
+		case "BODY":
+			val = strings.ToUpper(val)
+			if val != "7BIT" && val != "8BITMIME" {
+				return &Reply{ParameterSyntaxError, "5.5.4", "BODY must be 7BIT or 8BITMIME"}
+			}
+			m.Body = val
+		case "SMTPUTF8":
+			if val != "" {
+				return &Reply{ParameterSyntaxError, "5.5.4", "SMTPUTF8 doesn't take a value"}
+			}
+			m.UTF8 = true
+		default:
+			return &Reply{ParameterNotRecognized, "5.5.4", "Unsupported parameter: " + key}
+		}
+	}
+	return nil
+}
+
+// rcptParams applies parameters of the RCPT command to the recipient.
+func rcptParams(r *Recipient, params map[string]string) *Reply {
+	for key, val := range params {
+		switch key {
+		case "NOTIFY":
+			notify, err := dsn.ParseNotify(val)
+			if err != nil {
+				return &Reply{ParameterSyntaxError, "5.5.4", err.Error()}
+			}
+			r.Notify = notify
+		case "ORCPT":
+			orcpt, err := dsn.DecodeXtext(val)
+			if err != nil || strings.Index(orcpt, ";") <= 0 || len(val) > 500 {
+				return &Reply{ParameterSyntaxError, "5.5.4", "Invalid ORCPT value"}
+			}
+			r.ORCPT = orcpt
+		default:
+			return &Reply{ParameterNotRecognized, "5.5.4", "Unsupported parameter: " + key}
+		}
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package smtp
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/gaswelder/ring2/scanner"
 )
@@ -12,18 +16,24 @@ import (
 type Path struct {
 	// zero or more lists of hostnames like foo.com
 	Hosts []string
-	// address endpoint, like bob@example.net
+	// address endpoint, like bob@example.net,
+	// empty for the null reverse-path "<>"
 	Addr *Address
 }
 
+// Null returns true for the null reverse-path "<>".
+func (p *Path) Null() bool {
+	return p.Addr.Host == ""
+}
+
 func (p *Path) Format() string {
 	s := "<"
 	if len(p.Hosts) > 0 {
 		for i, host := range p.Hosts {
 			if i > 0 {
 				s += ","
-				s += "@" + host
 			}
+			s += "@" + host
 		}
 		s += ":"
 	}
@@ -31,8 +41,13 @@ func (p *Path) Format() string {
 	return s
 }
 
+// ParsePath reads a path as defined in RFC 5321 (4.1.2),
+// with the internationalized addresses of RFC 6531:
+//
 // "<@ONE,@TWO:JOE@THREE>"
 // "<joe@three>"
+// "<\"joe smith\"@[192.0.2.1]>"
+// "<>"
 func ParsePath(r *scanner.Scanner) (*Path, error) {
 
 	p := new(Path)
@@ -42,10 +57,19 @@ func ParsePath(r *scanner.Scanner) (*Path, error) {
 		return nil, r.Err()
 	}
 
+	if r.Next() == '>' {
+		r.Get()
+		p.Addr = &Address{}
+		return p, nil
+	}
+
 	if r.Next() == '@' {
 		for {
 			r.Expect('@')
-			host := readName(r)
+			host, err := readDomain(r)
+			if err != nil {
+				return nil, err
+			}
 			p.Hosts = append(p.Hosts, host)
 
 			ch := r.Get()
@@ -56,44 +80,153 @@ func ParsePath(r *scanner.Scanner) (*Path, error) {
 				break
 			}
 
-			return p, fmt.Errorf("Unexpected character: %c", ch)
+			return nil, fmt.Errorf("Unexpected character: %c", ch)
 		}
 	}
 
-	user := readName(r)
-	r.Expect('@')
-	host := readName(r)
-	r.Expect('>')
+	addr, err := readMailbox(r)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Expect('>') {
+		return nil, r.Err()
+	}
+	p.Addr = addr
+	return p, nil
+}
 
-	p.Addr = &Address{user, host}
-	return p, r.Err()
+// readMailbox reads a "local-part@domain" address.
+func readMailbox(r *scanner.Scanner) (*Address, error) {
+	name, err := readLocalPart(r)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Expect('@') {
+		return nil, r.Err()
+	}
+	host, err := readDomain(r)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.ValidString(name) || !utf8.ValidString(host) {
+		return nil, errors.New("Invalid UTF-8 in the address")
+	}
+	return &Address{name, host}, nil
 }
 
-func readName(r *scanner.Scanner) string {
-	name := ""
+// readLocalPart reads a dot-string or a quoted string and
+// returns its value, with the quotes and escapes removed.
+func readLocalPart(r *scanner.Scanner) (string, error) {
+	var name strings.Builder
+	if r.Next() == '"' {
+		r.Get()
+		for {
+			ch := r.Get()
+			switch {
+			case ch == '"':
+				return checkLocalPart(name.String())
+			case ch == '\\' && r.Next() >= 32 && r.Next() <= 126:
+				name.WriteByte(r.Get())
+			case isQtext(ch):
+				name.WriteByte(ch)
+			default:
+				return "", errors.New("Malformed quoted string")
+			}
+		}
+	}
+
 	for {
-		ch := r.Next()
-		if isAlpha(ch) || isDigit(ch) || ch == '.' || ch == '-' {
-			name += string(ch)
-			r.Get()
-			continue
+		if !isAtext(r.Next()) {
+			return "", errors.New("Malformed local part")
 		}
-		break
+		for isAtext(r.Next()) {
+			name.WriteByte(r.Get())
+		}
+		if r.Next() != '.' {
+			break
+		}
+		name.WriteByte(r.Get())
 	}
-	return name
+	return checkLocalPart(name.String())
 }
 
-func isDigit(c byte) bool {
-	return c >= '0' && c <= '9'
+func checkLocalPart(name string) (string, error) {
+	if len(name) > 64 {
+		return "", errors.New("Local part is too long")
+	}
+	return name, nil
 }
 
-// func isAlpha(c byte) bool {
-// 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
-// }
+// readDomain reads a domain name or an address literal
+// like "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+func readDomain(r *scanner.Scanner) (string, error) {
+	if r.Next() == '[' {
+		return readAddressLiteral(r)
+	}
 
-// func toUpper(c byte) byte {
-// 	if c >= 'a' && c <= 'z' {
-// 		c -= 'a' - 'A'
-// 	}
-// 	return c
-// }
+	var host strings.Builder
+	for {
+		// sub-domain = Let-dig [Ldh-str], or a U-label
+		start := host.Len()
+		for isLetDig(r.Next()) || r.Next() == '-' {
+			host.WriteByte(r.Get())
+		}
+		label := host.String()[start:]
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", errors.New("Malformed domain")
+		}
+		if r.Next() != '.' {
+			break
+		}
+		host.WriteByte(r.Get())
+	}
+	if host.Len() > 255 {
+		return "", errors.New("Domain is too long")
+	}
+	return host.String(), nil
+}
+
+func readAddressLiteral(r *scanner.Scanner) (string, error) {
+	r.Get()
+	lit := ""
+	for r.More() && r.Next() != ']' {
+		lit += string(r.Get())
+	}
+	if !r.Expect(']') {
+		return "", r.Err()
+	}
+
+	// Only IP addresses are accepted, not the general literals.
+	var ip net.IP
+	if strings.HasPrefix(strings.ToUpper(lit), "IPV6:") {
+		if strings.Contains(lit[5:], ":") {
+			ip = net.ParseIP(lit[5:])
+		}
+	} else if !strings.Contains(lit, ":") {
+		ip = net.ParseIP(lit)
+	}
+	if ip == nil {
+		return "", errors.New("Malformed address literal")
+	}
+	return "[" + lit + "]", nil
+}
+
+// isAtext returns true for characters allowed in atoms
+// (RFC 5322, 3.2.3), including UTF-8 (RFC 6531).
+func isAtext(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c >= 0x80 || c != 0 && strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// isQtext returns true for characters allowed in quoted
+// strings without escaping.
+func isQtext(c byte) bool {
+	return c >= 32 && c <= 126 && c != '"' && c != '\\' || c >= 0x80
+}
+
+func isLetDig(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/gaswelder/ring2/scanner"
+)
+
+func TestParsePath(t *testing.T) {
+	cases := []struct {
+		in    string
+		name  string
+		host  string
+		hosts int
+	}{
+		{"<joe@example.net>", "joe", "example.net", 0},
+		{"<joe.smith+tag@mail-1.example.net>", "joe.smith+tag", "mail-1.example.net", 0},
+		{"<joe_smith@localhost>", "joe_smith", "localhost", 0},
+		{"<!#$%&'*+-/=?^_`{|}~@example.net>", "!#$%&'*+-/=?^_`{|}~", "example.net", 0},
+		{`<"joe smith"@example.net>`, "joe smith", "example.net", 0},
+		{`<"joe\"q\\"@example.net>`, `joe"q\`, "example.net", 0},
+		{"<josé@example.net>", "josé", "example.net", 0},
+		{"<用户@例子.广告>", "用户", "例子.广告", 0},
+		{"<joe@[192.0.2.1]>", "joe", "[192.0.2.1]", 0},
+		{"<joe@[IPv6:2001:db8::1]>", "joe", "[IPv6:2001:db8::1]", 0},
+		{"<@one.net,@two.net:joe@three.net>", "joe", "three.net", 2},
+		{"<>", "", "", 0},
+	}
+	for _, c := range cases {
+		p, err := ParsePath(scanner.New(c.in))
+		if err != nil {
+			t.Errorf("%s: %s", c.in, err)
+			continue
+		}
+		if p.Addr.Name != c.name || p.Addr.Host != c.host || len(p.Hosts) != c.hosts {
+			t.Errorf("%s: got %q, %q, %v", c.in, p.Addr.Name, p.Addr.Host, p.Hosts)
+		}
+		if p.Format() != c.in {
+			t.Errorf("%s: formatted as %s", c.in, p.Format())
+		}
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	cases := []string{
+		"joe@example.net",
+		"<joe@example.net",
+		"<joe>",
+		"<@example.net>",
+		"<joe.@example.net>",
+		"<.joe@example.net>",
+		"<jo..e@example.net>",
+		"<jo e@example.net>",
+		`<"joe@example.net>`,
+		"<joe@-example.net>",
+		"<joe@example-.net>",
+		"<joe@example..net>",
+		"<joe@[300.0.0.1]>",
+		"<joe@[2001:db8::1]>",
+		"<joe@example.net\xff>",
+		"<@one.net joe@example.net>",
+	}
+	for _, c := range cases {
+		_, err := ParsePath(scanner.New(c))
+		if err == nil {
+			t.Errorf("%s: expected an error", c)
+		}
+	}
+}
@@ -6,20 +6,24 @@ import (
 	"io"
 )
 
+// ReadWriter reads commands and sends replies. Replies are buffered
+// and sent when the client has nothing more to say (see ReadLine)
+// or when Flush is called, so that a pipelined group of commands
+// gets its replies in one piece (RFC 2920).
 type ReadWriter struct {
-	conn io.Writer
+	conn *bufio.Writer
 	r    *bufio.Reader
 }
 
 func NewWriter(conn io.ReadWriter) *ReadWriter {
 	return &ReadWriter{
-		conn: conn,
+		conn: bufio.NewWriter(conn),
 		r:    bufio.NewReader(conn),
 	}
 }
 
 func (w *ReadWriter) ReadCommand() (*Command, error) {
-	line, err := w.r.ReadString('\n')
+	line, err := w.ReadLine()
 	if err != nil {
 		return nil, err
 	}
@@ -27,16 +31,48 @@ func (w *ReadWriter) ReadCommand() (*Command, error) {
 	return parseCommand(line)
 }
 
+// ReadLine reads the next line of the client's input. If all input
+// received so far has been processed, the pending replies are sent
+// first, because the client is probably waiting for them.
 func (w *ReadWriter) ReadLine() (string, error) {
+	if w.r.Buffered() == 0 {
+		err := w.Flush()
+		if err != nil {
+			return "", err
+		}
+	}
 	line, err := w.r.ReadString('\n')
 	return line, err
 }
 
+// CopyChunk copies exactly size bytes of the client's input to w.
+// It's used to read the data of BDAT commands.
+func (w *ReadWriter) CopyChunk(dst io.Writer, size int64) error {
+	_, err := io.CopyN(dst, w.r, size)
+	return err
+}
+
+// Flush sends the pending replies.
+func (w *ReadWriter) Flush() error {
+	return w.conn.Flush()
+}
+
+// DataReader returns a reader of the message text that follows
+// the DATA command.
+func (w *ReadWriter) DataReader() io.Reader {
+	return newDataReader(w.r)
+}
+
 func (w *ReadWriter) Send(code int, format string, args ...interface{}) {
 	line := fmt.Sprintf("%d %s", code, fmt.Sprintf(format, args...))
 	fmt.Fprintf(w.conn, "%s\r\n", line)
 }
 
+// Reply sends a reply with an enhanced status code.
+func (w *ReadWriter) Reply(r *Reply) {
+	fmt.Fprintf(w.conn, "%d %s %s\r\n", r.Code, r.Status, r.Text)
+}
+
 func (w *ReadWriter) BeginBatch(code int) *BatchWriter {
 	return newBatchWriter(code, w.conn)
 }
@@ -0,0 +1,33 @@
+package smtp
+
+import "fmt"
+
+// Reply is a server reply with an enhanced status code (RFC 3463).
+// Functions checking commands return replies as errors.
+type Reply struct {
+	Code int
+	// Status is the enhanced status code like "5.1.1".
+	Status string
+	Text   string
+}
+
+func reply(code int, status string, format string, args ...interface{}) *Reply {
+	return &Reply{code, status, fmt.Sprintf(format, args...)}
+}
+
+func (r *Reply) Error() string {
+	return fmt.Sprintf("%d %s %s", r.Code, r.Status, r.Text)
+}
+
+// Replies used by several commands.
+var (
+	replyOK             = &Reply{250, "2.0.0", "OK"}
+	errNotInMailMode    = &Reply{BadSequenceOfCommands, "5.5.1", "Not in mail mode"}
+	errNoRecipients     = &Reply{BadSequenceOfCommands, "5.5.1", "No recipients specified"}
+	errNoRelay          = &Reply{550, "5.7.1", "Relaying denied"}
+	errNoMailbox        = &Reply{550, "5.1.1", "No such user here"}
+	errNeedSMTPUTF8     = &Reply{553, "5.6.7", "Non-ASCII addresses require the SMTPUTF8 parameter"}
+	errTooBigMessage    = &Reply{MessageTooBig, "5.3.4", "Message size exceeds fixed maximum message size"}
+	errSpoolUnavailable = &Reply{451, "4.3.0", "Couldn't store the message"}
+	errSpoolFailed      = &Reply{452, "4.3.1", "Insufficient system storage"}
+)
@@ -2,17 +2,20 @@ package smtp
 
 import (
 	"encoding/base64"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"os"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gaswelder/ring2/scanner"
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
 /*
  * HELO <host>
+ *
+ * Replies to HELO and EHLO don't have enhanced status codes (RFC 2034).
  */
 func cmdHelo(s *session, cmd *Command) {
 	if cmd.Arg == "" {
@@ -36,8 +39,8 @@ func cmdEhlo(s *session, cmd *Command) {
 	// Send greeting and a list of supported extensions
 	w := s.BeginBatch(250)
 	w.Send("Hello, %s", cmd.Arg)
-	for name := range smtpExts {
-		w.Send("%s", name)
+	for _, ext := range s.extensions() {
+		w.Send("%s", ext)
 	}
 	w.End()
 }
@@ -46,8 +49,8 @@ func cmdEhlo(s *session, cmd *Command) {
  * RSET - reset everything
  */
 func cmdRset(s *session, cmd *Command) {
-	s.draft = nil
-	s.Send(250, "OK")
+	s.reset()
+	s.Reply(replyOK)
 }
 
 /*
@@ -56,31 +59,55 @@ func cmdRset(s *session, cmd *Command) {
 func cmdMail(s *session, cmd *Command) {
 
 	if s.senderHost == "" {
-		s.Send(503, "HELO expected")
+		s.Reply(&Reply{BadSequenceOfCommands, "5.5.1", "HELO expected"})
+		return
+	}
+	if s.config.RequireTLS && !s.tls {
+		s.Reply(&Reply{530, "5.7.0", "Must issue a STARTTLS command first"})
+		return
+	}
+	if s.config.RequireAuth && !s.auth {
+		s.Reply(&Reply{530, "5.7.0", "Authentication required"})
 		return
 	}
 
 	p := scanner.New(cmd.Arg)
 	if !p.SkipStri("FROM:") {
-		s.Send(501, "The format is: MAIL FROM:<reverse-path>[ <params>]")
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "The format is: MAIL FROM:<reverse-path>[ <params>]"})
 		return
 	}
 
 	// Read the <path> part
 	rpath, err := ParsePath(p)
 	if err != nil {
-		s.Send(501, "Malformed reverse-path")
+		s.Reply(&Reply{ParameterSyntaxError, "5.1.7", "Malformed reverse-path"})
 		return
 	}
 
-	// If <params> part follows, read it,
-	// but don't do anything with it
-	if p.More() && p.Next() == ' ' {
-		log.Println("MAIL params: " + p.Rest())
+	draft := NewDraft(rpath)
+	params, err := parseParams(p.Rest())
+	if err != nil {
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.4", err.Error()})
+		return
+	}
+	rerr := s.mailParams(draft, params)
+	if rerr != nil {
+		s.Reply(rerr)
+		return
+	}
+	if !rpath.Addr.ASCII() && !draft.UTF8 {
+		s.Reply(errNeedSMTPUTF8)
+		return
+	}
+	// Authenticated users may send only as themselves.
+	if s.auth && s.config.CheckSender != nil && !s.config.CheckSender(s.user, rpath.Addr) {
+		s.Reply(reply(553, "5.7.1", "Sender address <%s> is not owned by %s", rpath.Addr.Format(), s.user))
+		return
 	}
 
-	s.draft = NewDraft(rpath)
-	s.Send(250, "OK")
+	s.reset()
+	s.draft = draft
+	s.Reply(&Reply{250, "2.1.0", "OK"})
 }
 
 /*
@@ -88,36 +115,68 @@ func cmdMail(s *session, cmd *Command) {
  */
 func cmdRcpt(s *session, cmd *Command) {
 	if s.draft == nil {
-		s.Send(BadSequenceOfCommands, "Not in mail mode")
+		s.Reply(errNotInMailMode)
 		return
 	}
 
 	p := scanner.New(cmd.Arg)
 	if !p.SkipStri("TO:") {
-		s.Send(ParameterSyntaxError, "The format is: RCPT TO:<forward-path>")
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "The format is: RCPT TO:<forward-path>"})
 		return
 	}
 
 	path, err := ParsePath(p)
+	if err != nil || path.Null() {
+		s.Reply(&Reply{ParameterSyntaxError, "5.1.3", "Malformed forward-path"})
+		return
+	}
+	if !path.Addr.ASCII() && !s.draft.UTF8 {
+		s.Reply(errNeedSMTPUTF8)
+		return
+	}
+
+	rcpt := &Recipient{Path: path}
+	params, err := parseParams(p.Rest())
 	if err != nil {
-		s.Send(ParameterSyntaxError, "Malformed forward-path")
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.4", err.Error()})
+		return
+	}
+	rerr := rcptParams(rcpt, params)
+	if rerr != nil {
+		s.Reply(rerr)
 		return
 	}
 
 	if len(path.Hosts) > 0 {
-		s.Send(551, "This server does not relay")
+		s.Reply(errNoRelay)
 		return
 	}
 
-	mailboxes, err := s.lookup(path.Addr.Name)
+	if !s.isLocal(path.Addr.Host) {
+		// Only known users may send mail outside.
+		if !s.auth || s.config.Relay == nil {
+			s.Reply(errNoRelay)
+			return
+		}
+		s.relayTo = append(s.relayTo, rcpt)
+		s.Reply(&Reply{250, "2.1.5", "OK"})
+		s.draft.Recipients = append(s.draft.Recipients, rcpt)
+		return
+	}
+	mailboxes, err := s.config.Lookup(path.Addr)
+	if err == ErrUnknownRecipient {
+		s.Reply(errNoMailbox)
+		return
+	}
 	if err != nil {
-		s.Send(550, err.Error())
+		log.Printf("couldn't look up mailboxes of %s: %s", path.Addr.Format(), err.Error())
+		s.Reply(&Reply{451, "4.3.0", "Couldn't look up the mailbox"})
 		return
 	}
-	s.recipients = append(s.recipients, mailboxes...)
+	s.recipients = append(s.recipients, &localRecipient{rcpt, mailboxes})
 
-	s.Send(250, "OK")
-	s.draft.Recipients = append(s.draft.Recipients, path)
+	s.Reply(&Reply{250, "2.1.5", "OK"})
+	s.draft.Recipients = append(s.draft.Recipients, rcpt)
 }
 
 /*
@@ -126,123 +185,281 @@ func cmdRcpt(s *session, cmd *Command) {
 func cmdData(s *session, cmd *Command) {
 
 	if s.draft == nil {
-		s.Send(503, "Not in mail mode")
+		s.Reply(errNotInMailMode)
 		return
 	}
 
 	if len(s.draft.Recipients) == 0 {
-		s.Send(503, "No recipients specified")
+		s.Reply(errNoRecipients)
 		return
 	}
 
-	s.Send(354, "Start mail input, terminate with a dot line (.)")
+	if s.chunks != nil {
+		s.Reply(&Reply{BadSequenceOfCommands, "5.5.1", "DATA can't be mixed with BDAT"})
+		return
+	}
 
 	/*
-	 * Read the message
+	 * Write the message to a spool file as it arrives. If it grows
+	 * over the limit, keep reading until the end, but discard the rest.
 	 */
-	text := ""
-	for {
-		line, err := s.ReadLine()
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	spool, err := s.newSpool()
+	if err != nil {
+		log.Printf("couldn't create a spool file: %s", err.Error())
+		s.Reply(errSpoolUnavailable)
+		return
+	}
+	defer removeSpool(spool)
 
-		if line == ".\r\n" {
-			break
+	// The client waits for this reply before sending the text,
+	// so it can't be held back with the other replies. Intermediate
+	// replies don't have enhanced status codes.
+	s.Send(354, "Start mail input, terminate with a dot line (.)")
+	s.Flush()
+
+	data := s.DataReader()
+	w := &spoolWriter{w: spool}
+	size, err := copyLimited(w, data, s.config.MaxSize)
+	if err == errTooBig {
+		_, err = io.Copy(ioutil.Discard, data)
+		if err == nil {
+			s.reset()
+			s.Reply(errTooBigMessage)
+			return
 		}
+	}
+	if err != nil {
+		// The client's input is broken.
+		log.Println(err)
+		s.closed = true
+		return
+	}
+	if w.err != nil {
+		log.Printf("couldn't write the spool file: %s", w.err.Error())
+		s.reset()
+		s.Reply(errSpoolFailed)
+		return
+	}
 
-		/*
-		 * If the line starts with a dot and there are other
-		 * characters, remove the dot.
-		 */
-		if line[0] == '.' {
-			line = line[1:]
-		}
+	s.deliver(spool, size)
+}
 
-		text += line
+/*
+ * BDAT <size> [LAST]
+ */
+func cmdBdat(s *session, cmd *Command) {
+	args := strings.Fields(cmd.Arg)
+	if len(args) == 0 || len(args) > 2 {
+		// Without the size the chunk can't be skipped,
+		// so there's no way to go on.
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "The format is: BDAT <size> [LAST]"})
+		s.closed = true
+		return
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.4", "Invalid chunk size"})
+		s.closed = true
+		return
 	}
+	last := len(args) == 2 && strings.EqualFold(args[1], "LAST")
 
 	/*
-	 * Insert a stamp at the beginning of the message
-	 * Example: Received: from GHI.ARPA by JKL.ARPA ; 27 Oct 81 15:27:39 PST
+	 * The chunk follows the command in any case, so when the
+	 * command fails, the chunk still has to be read.
 	 */
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Printf("failed to get hostname: %s\n", err.Error())
-		hostname = "localhost"
+	fail := func(r *Reply) {
+		err := s.CopyChunk(ioutil.Discard, size)
+		if err != nil {
+			log.Println(err)
+			s.closed = true
+			return
+		}
+		s.Reply(r)
 	}
 
-	rpathLine := fmt.Sprintf("Return-Path: %s\r\n", s.draft.Sender.Format())
-	receivedLine := fmt.Sprintf("Received: from %s by %s ; %s\r\n",
-		s.senderHost, hostname, time.Now().Format(time.RFC822))
-
-	text = rpathLine + receivedLine + text
+	switch {
+	case len(args) == 2 && !last:
+		fail(&Reply{ParameterSyntaxError, "5.5.2", "The format is: BDAT <size> [LAST]"})
+		return
+	case s.draft == nil:
+		fail(errNotInMailMode)
+		return
+	case len(s.draft.Recipients) == 0:
+		fail(errNoRecipients)
+		return
+	case s.tooBig(s.chunkSize + size):
+		s.reset()
+		fail(errTooBigMessage)
+		return
+	}
 
-	for _, mailbox := range s.recipients {
-		err := mailbox.Add(text)
+	if s.chunks == nil {
+		spool, err := s.newSpool()
 		if err != nil {
-			s.Send(554, "Couldn't send to %s: %s", mailbox.Name(), err.Error())
+			log.Printf("couldn't create a spool file: %s", err.Error())
+			fail(errSpoolUnavailable)
 			return
 		}
+		s.chunks = spool
 	}
-	s.Send(250, "OK")
-}
+	w := &spoolWriter{w: s.chunks}
+	err = s.CopyChunk(w, size)
+	if err != nil {
+		log.Println(err)
+		s.closed = true
+		return
+	}
+	if w.err != nil {
+		log.Printf("couldn't write the spool file: %s", w.err.Error())
+		s.reset()
+		s.Reply(errSpoolFailed)
+		return
+	}
+	s.chunkSize += size
 
-func cmdHelp(s *session, cmd *Command) {
-	s.Send(214, helpfulMessage())
+	if !last {
+		s.Reply(reply(250, "2.0.0", "%d octets received", size))
+		return
+	}
+	s.deliver(s.chunks, s.chunkSize)
+	// The transaction is over even if the delivery has failed.
+	s.reset()
 }
 
-// AUTH <type> <arg>
-func cmdAuth(s *session, cmd *Command) {
-	// Naively split the auth arguments by a single space.
-	parts := strings.Split(cmd.Arg, " ")
-
-	// Here we are prepared to deal only with the "PLAIN <...>"" case.
-	if len(parts) != 2 || parts[0] != "PLAIN" {
-		s.Send(ParameterNotImplemented, "Only PLAIN <...> is supported")
+/*
+ * STARTTLS
+ */
+func cmdStarttls(s *session, cmd *Command) {
+	if cmd.Arg != "" {
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.4", "No parameters allowed"})
 		return
 	}
-
-	// If already authorized, reject
-	if s.auth {
-		s.Send(BadSequenceOfCommands, "Already authorized")
+	if s.tls {
+		s.Reply(&Reply{BadSequenceOfCommands, "5.5.1", "Already running TLS"})
 		return
 	}
-
-	user, password, smtpErr := plainAuth(parts[1])
-	if smtpErr != nil {
-		s.Send(smtpErr.code, smtpErr.message)
+	if s.starttls == nil {
+		s.Reply(&Reply{454, "4.7.0", "TLS not available"})
 		return
 	}
 
-	if s.authorize(user, password) != nil {
-		s.Send(AuthInvalid, "Authentication credentials invalid")
+	s.Reply(&Reply{220, "2.0.0", "Ready to start TLS"})
+	err := s.Flush()
+	if err != nil {
+		log.Println(err)
+		s.closed = true
+		return
+	}
+	conn, err := s.starttls()
+	if err != nil {
+		// The connection is in an undefined state now,
+		// so there's no point in continuing.
+		log.Printf("TLS handshake failed: %s", err.Error())
+		s.closed = true
 		return
 	}
 
-	s.auth = true
-	s.Send(AuthOK, "Authentication succeeded")
+	// RFC 3207 requires the server to forget everything it has
+	// learned from the client before the upgrade, including any
+	// commands that were sent after STARTTLS in plaintext.
+	s.ReadWriter = NewWriter(conn)
+	s.tls = true
+	s.senderHost = ""
+	s.auth = false
+	s.user = ""
+	s.reset()
 }
 
-type smtpError struct {
-	code    int
-	message string
+/*
+ * HELP
+ */
+func cmdHelp(s *session, cmd *Command) {
+	s.Reply(&Reply{214, "2.0.0", helpText})
 }
 
-func plainAuth(arg string) (login, pass string, serr *smtpError) {
-	// AGdhcwAxMjM= -> \0user\0pass
-	data, err := base64.StdEncoding.DecodeString(arg)
-	if err != nil {
-		return "", "", &smtpError{ParameterSyntaxError, err.Error()}
+/*
+ * AUTH <mechanism> [<initial-response>]
+ */
+func cmdAuth(s *session, cmd *Command) {
+	if s.auth {
+		s.Reply(&Reply{BadSequenceOfCommands, "5.5.1", "Already authorized"})
+		return
+	}
+	if s.draft != nil {
+		s.Reply(&Reply{BadSequenceOfCommands, "5.5.1", "AUTH is not allowed during a mail transaction"})
+		return
+	}
+	if s.config.RequireTLS && !s.tls {
+		s.Reply(&Reply{538, "5.7.11", "Encryption required for requested authentication mechanism"})
+		return
 	}
 
-	parts := strings.Split(string(data), "\x00")
-	if len(parts) != 3 {
-		return "", "", &smtpError{ParameterSyntaxError, "Could not parse the auth string"}
+	args := strings.Fields(cmd.Arg)
+	if len(args) == 0 || len(args) > 2 {
+		s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "The format is: AUTH <mechanism> [<initial-response>]"})
+		return
 	}
+	m, ok := sasl.New(args[0], s.config.Auth)
+	if !ok {
+		s.Reply(&Reply{ParameterNotImplemented, "5.5.4", "Unrecognized authentication type"})
+		return
+	}
+
+	// A single "=" is an empty initial response (RFC 4954).
+	var response []byte
+	if len(args) == 2 {
+		var err error
+		response, err = decodeResponse(args[1])
+		if err != nil {
+			s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "Malformed initial response"})
+			return
+		}
+	}
+
+	for {
+		challenge, done, err := m.Next(response)
+		if err == sasl.ErrSyntax {
+			s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "Malformed response"})
+			return
+		}
+		if err != nil {
+			s.Reply(&Reply{AuthInvalid, "5.7.8", "Authentication credentials invalid"})
+			return
+		}
+		if done {
+			break
+		}
 
-	login = parts[1]
-	pass = parts[2]
-	return login, pass, nil
+		// Challenges are intermediate replies, which don't
+		// have enhanced status codes.
+		s.Send(334, "%s", base64.StdEncoding.EncodeToString(challenge))
+		line, err := s.ReadLine()
+		if err != nil {
+			log.Println(err)
+			s.closed = true
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "*" {
+			s.Reply(&Reply{ParameterSyntaxError, "5.0.0", "Authentication cancelled"})
+			return
+		}
+		response, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			s.Reply(&Reply{ParameterSyntaxError, "5.5.2", "Malformed response"})
+			return
+		}
+	}
+
+	s.auth = true
+	s.user = m.User()
+	s.Reply(&Reply{AuthOK, "2.7.0", "Authentication succeeded"})
+}
+
+func decodeResponse(arg string) ([]byte, error) {
+	if arg == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(arg)
 }
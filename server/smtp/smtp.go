@@ -1,11 +1,15 @@
 package smtp
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/gaswelder/ring2/server/mailbox"
+	"github.com/gaswelder/ring2/server/sasl"
 )
 
 type cmdFunc func(s *session, cmd *Command)
@@ -17,13 +21,17 @@ var commands = map[string]cmdFunc{
 	"MAIL": cmdMail,
 	"RCPT": cmdRcpt,
 	"DATA": cmdData,
+	"BDAT": cmdBdat,
+	"VRFY": cmdVrfy,
+	"EXPN": cmdExpn,
 }
 
-// Extensions are registered separately because they are listed
-// by the EHLO command.
+// Commands added by extensions. The extensions themselves
+// are listed by the EHLO command, see session.extensions.
 var smtpExts = map[string]cmdFunc{
-	"HELP": cmdHelp,
-	"AUTH": cmdAuth,
+	"HELP":     cmdHelp,
+	"AUTH":     cmdAuth,
+	"STARTTLS": cmdStarttls,
 }
 
 const AuthOK = 235
@@ -32,45 +40,137 @@ const BadSequenceOfCommands = 503
 const ParameterNotImplemented = 504
 const AuthInvalid = 535
 
-type AuthFunc func(name, password string) error
-type MailboxLookupFunc func(name string) ([]*mailbox.Mailbox, error)
+// MailboxLookupFunc returns mailboxes that mail for the given
+// address in a local domain should be put to.
+type MailboxLookupFunc func(addr *Address) ([]*mailbox.Mailbox, error)
+
+// RelayFunc accepts a message for delivery to remote recipients.
+type RelayFunc func(m *Mail, to []*Recipient, text io.Reader) error
+
+// NotifyFunc sends a delivery status notification to the sender.
+type NotifyFunc func(sender string, text io.Reader) error
+
+// VerifyFunc returns the full address of a local user. The
+// address given may have an empty host.
+type VerifyFunc func(addr *Address) (*Address, error)
+
+// ExpandFunc returns addresses of the members of a local mailing
+// list. The address given may have an empty host.
+type ExpandFunc func(addr *Address) ([]*Address, error)
+
+// SenderFunc returns true if the authenticated user may
+// send mail from the given address.
+type SenderFunc func(user string, addr *Address) bool
+
+// ErrNotLocal is returned by lookup functions for addresses
+// that are not served by this server.
+var ErrNotLocal = errors.New("address is not local")
+
+// ErrUnknownRecipient is returned by lookup functions for local
+// addresses that nobody receives mail at.
+var ErrUnknownRecipient = errors.New("unknown recipient")
+
+// Config describes the environment SMTP sessions work in.
+type Config struct {
+	// Auth checks credentials given with the AUTH command.
+	Auth   sasl.Backend
+	Lookup MailboxLookupFunc
+	// Relay takes messages from authenticated users to remote
+	// recipients. If nil, relaying is not allowed.
+	Relay RelayFunc
+	// Notify sends delivery status notifications.
+	Notify NotifyFunc
+	// Hostname is the name the server introduces itself with in
+	// the greeting, trace fields and notifications. Mail for
+	// addresses in this domain is delivered locally.
+	Hostname string
+	// Domains are other domains mail for which is
+	// delivered locally.
+	Domains []string
+	// MaxSize is the message size limit in bytes, 0 if there
+	// is no limit.
+	MaxSize int64
+	// TempDir is where incoming messages are kept until they are
+	// delivered. If empty, the system's default is used.
+	TempDir string
+	// Verify and Expand serve the VRFY and EXPN commands. If nil,
+	// the commands are not available.
+	Verify VerifyFunc
+	Expand ExpandFunc
+	// If set, VRFY and EXPN may be used without authentication.
+	VerifyAnon bool
+	// If set, authenticated clients may send mail only from
+	// the addresses this function allows.
+	CheckSender SenderFunc
+	// If set, MAIL is accepted only from authenticated clients.
+	RequireAuth bool
+	// If set, MAIL and AUTH are accepted only over TLS.
+	RequireTLS bool
+	// TLS tells that connections are TLS from the first byte.
+	TLS bool
+}
+
+// TLSFunc upgrades the session's connection to TLS and returns
+// the stream to continue the session over.
+type TLSFunc func() (io.ReadWriter, error)
 
 type session struct {
 	*ReadWriter
 	senderHost string
 	draft      *Mail
 	auth       bool
-	authorize  AuthFunc
-	lookup     MailboxLookupFunc
-	recipients []*mailbox.Mailbox
+	// Name of the authenticated user.
+	user       string
+	config     *Config
+	recipients []*localRecipient
+	// Recipients to be relayed to remote servers.
+	relayTo []*Recipient
+	// Spool file with the chunks received by BDAT commands so far,
+	// nil if BDAT hasn't been used in the transaction.
+	chunks    *os.File
+	chunkSize int64
+	// Upgrades the connection, nil if TLS is not available.
+	starttls TLSFunc
+	// Whether the session runs over TLS.
+	tls bool
+	// Set when the connection can't be used anymore.
+	closed bool
 }
 
-func Process(conn io.ReadWriter, auth AuthFunc, lookup MailboxLookupFunc) {
+// Process runs an SMTP session over the given connection.
+// If starttls is not nil, the STARTTLS extension is offered.
+func Process(conn io.ReadWriter, config *Config, starttls TLSFunc) {
 	s := &session{
 		ReadWriter: NewWriter(conn),
-		authorize:  auth,
-		lookup:     lookup,
-		recipients: make([]*mailbox.Mailbox, 0),
-	}
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Printf("couldn't get hostname: %s", err.Error())
-		hostname = "localhost"
+		config:     config,
+		starttls:   starttls,
+		tls:        config.TLS,
 	}
-	s.Send(220, "%s ready", hostname)
+	s.reset()
+	s.Send(220, "%s ready", config.Hostname)
 
-	for {
-		cmd, err := s.ReadCommand()
-		if err == io.EOF {
+	// STARTTLS replaces the writer, so the one to flush
+	// is looked up at the end.
+	defer func() { s.Flush() }()
+	// Drop the unfinished transaction, if any.
+	defer s.reset()
+
+	for !s.closed {
+		line, err := s.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
 			break
 		}
+		cmd, err := parseCommand(line)
 		if err != nil {
-			s.Send(500, err.Error())
+			s.Reply(&Reply{500, "5.5.2", err.Error()})
 			continue
 		}
 
 		if cmd.Name == "QUIT" {
-			s.Send(221, "So long, Bob")
+			s.Reply(&Reply{221, "2.0.0", "Bye"})
 			break
 		}
 
@@ -79,9 +179,64 @@ func Process(conn io.ReadWriter, auth AuthFunc, lookup MailboxLookupFunc) {
 			f, ok = smtpExts[cmd.Name]
 		}
 		if !ok {
-			s.Send(500, "Unknown command")
+			s.Reply(&Reply{500, "5.5.1", "Unknown command"})
 			continue
 		}
 		f(s, cmd)
 	}
 }
+
+// reset discards the current mail transaction.
+func (s *session) reset() {
+	s.draft = nil
+	s.recipients = make([]*localRecipient, 0)
+	s.relayTo = make([]*Recipient, 0)
+	if s.chunks != nil {
+		removeSpool(s.chunks)
+		s.chunks = nil
+		s.chunkSize = 0
+	}
+}
+
+// extensions returns EHLO keywords of the extensions
+// available in the session.
+func (s *session) extensions() []string {
+	list := []string{"HELP"}
+	// Credentials are not to be sent in plaintext
+	// where the policy requires TLS.
+	if s.tls || !s.config.RequireTLS {
+		list = append(list, "AUTH "+strings.Join(sasl.Names(), " "))
+	}
+	list = append(list,
+		"DSN",
+		fmt.Sprintf("SIZE %d", s.config.MaxSize),
+		"PIPELINING",
+		"8BITMIME",
+		"SMTPUTF8",
+		"CHUNKING",
+		"ENHANCEDSTATUSCODES",
+	)
+	if s.starttls != nil && !s.tls {
+		list = append(list, "STARTTLS")
+	}
+	return list
+}
+
+// isLocal returns true if mail for the domain is delivered locally.
+func (s *session) isLocal(host string) bool {
+	if strings.EqualFold(host, s.config.Hostname) {
+		return true
+	}
+	for _, d := range s.config.Domains {
+		if strings.EqualFold(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// tooBig returns true if a message of the given size
+// exceeds the limit.
+func (s *session) tooBig(size int64) bool {
+	return s.config.MaxSize > 0 && size > s.config.MaxSize
+}
@@ -0,0 +1,664 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaswelder/ring2/server/internal/testutil"
+	"github.com/gaswelder/ring2/server/mailbox"
+)
+
+// testConfig returns a config with a single local user "bob".
+func testConfig(t *testing.T) (*Config, *mailbox.Mailbox) {
+	box, err := mailbox.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Auth: testutil.Users{},
+		Lookup: func(addr *Address) ([]*mailbox.Mailbox, error) {
+			if addr.Name != "bob" {
+				return nil, ErrUnknownRecipient
+			}
+			return []*mailbox.Mailbox{box}, nil
+		},
+		Hostname: "localhost",
+		TempDir:  t.TempDir(),
+	}
+	return config, box
+}
+
+// messages returns texts of all messages in the mailbox.
+func messages(t *testing.T, box *mailbox.Mailbox) []string {
+	list, err := box.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := make([]string, 0, len(list))
+	for _, m := range list {
+		r, err := m.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, string(text))
+	}
+	return texts
+}
+
+// replyCodes returns codes of the final lines of the replies.
+func replyCodes(text string) []string {
+	codes := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n") {
+		if len(line) > 3 && line[3] == ' ' {
+			codes = append(codes, line[:3])
+		}
+	}
+	return codes
+}
+
+func TestPipelinedReplies(t *testing.T) {
+	config, box := testConfig(t)
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"RCPT TO:<nobody@localhost>\r\n" +
+		"DATA\r\n" +
+		"Subject: hi\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+
+	// The greeting is sent on its own, then the replies to the whole
+	// group up to DATA, then the rest.
+	if len(conn.Writes) != 3 {
+		t.Fatalf("expected 3 writes, got %q", conn.Writes)
+	}
+	expected := []string{"250", "250", "250", "550", "354"}
+	codes := replyCodes(conn.Writes[1])
+	if strings.Join(codes, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected replies %v, got %v", expected, codes)
+	}
+	if !strings.Contains(conn.Writes[1], "PIPELINING\r\n") {
+		t.Errorf("PIPELINING is not advertised: %q", conn.Writes[1])
+	}
+	codes = replyCodes(conn.Writes[2])
+	if strings.Join(codes, " ") != "250 221" {
+		t.Errorf("unexpected final replies: %v", codes)
+	}
+
+	texts := messages(t, box)
+	if len(texts) != 1 || !strings.HasSuffix(texts[0], "Subject: hi\r\n\r\nHello\r\n") {
+		t.Errorf("unexpected mailbox contents: %q", texts)
+	}
+}
+
+func TestPipelinedTransactions(t *testing.T) {
+	config, box := testConfig(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		Process(server, config, nil)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+
+	expect := func(code string) {
+		t.Helper()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line[:3] != code {
+				t.Fatalf("expected %s, got %q", code, line)
+			}
+			if line[3] == ' ' {
+				return
+			}
+		}
+	}
+	send := func(text string) {
+		t.Helper()
+		_, err := io.WriteString(client, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect("220")
+	send("EHLO client\r\n")
+	expect("250")
+
+	// Two transactions, each sent as a group.
+	for i := 0; i < 2; i++ {
+		send("MAIL FROM:<joe@example.net>\r\nRCPT TO:<bob@localhost>\r\nDATA\r\n")
+		expect("250")
+		expect("250")
+		expect("354")
+		send(fmt.Sprintf("Subject: %d\r\n\r\n..one\r\n.\r\n", i))
+		expect("250")
+	}
+
+	// A transaction without valid recipients, so its DATA must fail.
+	send("RSET\r\nMAIL FROM:<joe@example.net>\r\nRCPT TO:<nobody@localhost>\r\nDATA\r\nQUIT\r\n")
+	expect("250")
+	expect("250")
+	expect("550")
+	expect("503")
+	expect("221")
+
+	texts := messages(t, box)
+	if len(texts) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(texts))
+	}
+	for _, text := range texts {
+		if !strings.HasSuffix(text, "\r\n.one\r\n") {
+			t.Errorf("unexpected message: %q", text)
+		}
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if len(rest) > 0 {
+		t.Errorf("unexpected replies after QUIT: %q", rest)
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	config, _ := testConfig(t)
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"MAIL FROM:<josé@example.net>\r\n" +
+		"MAIL FROM:<josé@example.net> SMTPUTF8 BODY=8BITMIME\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"RSET\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<bøb@localhost>\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+
+	codes := replyCodes(conn.String())
+	expected := "220 250 553 250 250 250 250 553 221"
+	if strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+}
+
+func TestChunking(t *testing.T) {
+	config, box := testConfig(t)
+	chunk1 := "Subject: hi\r\n\r\n.\r\n"
+	chunk2 := "..binary\x00\xff\r\nQUIT\r\n"
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"BDAT 3\r\nabc" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		fmt.Sprintf("BDAT %d\r\n%s", len(chunk1), chunk1) +
+		"DATA\r\n" +
+		fmt.Sprintf("BDAT %d LAST\r\n%s", len(chunk2), chunk2) +
+		"BDAT 0 LAST\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+
+	all := conn.String()
+	if !strings.Contains(all, "CHUNKING\r\n") {
+		t.Errorf("CHUNKING is not advertised: %q", all)
+	}
+	codes := replyCodes(all)
+	expected := "220 250 503 250 250 250 503 250 503 221"
+	if strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+
+	texts := messages(t, box)
+	if len(texts) != 1 || !strings.HasSuffix(texts[0], "\r\n"+chunk1+chunk2) {
+		t.Errorf("unexpected mailbox contents: %q", texts)
+	}
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	config, _ := testConfig(t)
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"MAIL FROM:<joe@example.net> FOO=1\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<nobody@localhost>\r\n" +
+		"RCPT TO:<alice@example.org>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"DATA\r\n" +
+		"Subject: hi\r\n\r\nHello\r\n.\r\n" +
+		"STARTTLS\r\n" +
+		"AUTH NTLM\r\n" +
+		"HELP\r\n" +
+		"NOOPS\r\n" +
+		"RSET\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+
+	all := conn.String()
+	if !strings.Contains(all, "ENHANCEDSTATUSCODES\r\n") {
+		t.Errorf("ENHANCEDSTATUSCODES is not advertised: %q", all)
+	}
+	status := regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+	lines := strings.Split(strings.TrimSuffix(all, "\r\n"), "\r\n")
+	for i, line := range lines {
+		code := line[:3]
+		// The greeting, the EHLO reply and intermediate
+		// replies don't have status codes.
+		if i == 0 || line[3] == '-' || lines[i-1][3] == '-' || code == "354" {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 || !status.MatchString(f[1]) || f[1][0] != code[0] {
+			t.Errorf("no enhanced status code in %q", line)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	config, _ := testConfig(t)
+	config.Auth = testutil.Users{"joe": "123"}
+	config.Verify = func(addr *Address) (*Address, error) {
+		if addr.Name != "bob" {
+			return nil, errors.New("unknown user")
+		}
+		return &Address{"bob", "localhost"}, nil
+	}
+	config.Expand = func(addr *Address) ([]*Address, error) {
+		if addr.Name != "staff" {
+			return nil, errors.New("unknown list")
+		}
+		return []*Address{{"bob", "localhost"}, {"joe", "localhost"}}, nil
+	}
+	script := "EHLO client\r\n" +
+		"VRFY bob\r\n" +
+		"AUTH PLAIN AGpvZQAxMjM=\r\n" +
+		"VRFY bob\r\n" +
+		"VRFY <bob@localhost>\r\n" +
+		"VRFY alice\r\n" +
+		"EXPN staff\r\n" +
+		"EXPN bob\r\n" +
+		"QUIT\r\n"
+
+	conn := &testutil.Recorder{Reader: strings.NewReader(script)}
+	Process(conn, config, nil)
+	all := conn.String()
+	codes := replyCodes(all)
+	expected := "220 250 530 235 250 250 550 250 550 221"
+	if strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+	if !strings.Contains(all, "250-2.1.5 <bob@localhost>\r\n250 2.1.5 <joe@localhost>\r\n") {
+		t.Errorf("unexpected EXPN reply: %q", all)
+	}
+
+	// Unauthenticated clients may be allowed to use the commands.
+	config.VerifyAnon = true
+	conn = &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\nVRFY bob\r\nQUIT\r\n")}
+	Process(conn, config, nil)
+	codes = replyCodes(conn.String())
+	if strings.Join(codes, " ") != "220 250 250 221" {
+		t.Errorf("unexpected replies: %v", codes)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	cases := []struct {
+		script   string
+		expected string
+	}{
+		{"AUTH PLAIN " + b64("\x00joe\x00123") + "\r\n", "235"},
+		{"AUTH PLAIN\r\n" + b64("\x00joe\x00123") + "\r\n", "334 235"},
+		{"AUTH plain =\r\n", "501"},
+		{"AUTH LOGIN\r\n" + b64("joe") + "\r\n" + b64("123") + "\r\n", "334 334 235"},
+		{"AUTH LOGIN " + b64("joe") + "\r\n" + b64("124") + "\r\n", "334 535"},
+		{"AUTH LOGIN\r\n*\r\n", "334 501"},
+		{"AUTH LOGIN\r\n!!!\r\n", "334 501"},
+		{"AUTH NTLM\r\n", "504"},
+	}
+	for _, c := range cases {
+		config, _ := testConfig(t)
+		config.Auth = testutil.Users{"joe": "123"}
+		conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" + c.script + "QUIT\r\n")}
+		Process(conn, config, nil)
+
+		all := conn.String()
+		codes := replyCodes(all)
+		expected := "220 250 " + c.expected + " 221"
+		if strings.Join(codes, " ") != expected {
+			t.Errorf("%q: expected %s, got %v", c.script, expected, codes)
+		}
+		if !strings.Contains(all, "250-AUTH PLAIN LOGIN CRAM-MD5 SCRAM-SHA-256\r\n") {
+			t.Errorf("mechanisms are not advertised: %q", all)
+		}
+	}
+}
+
+func TestAuthCramMD5(t *testing.T) {
+	config, _ := testConfig(t)
+	config.Auth = testutil.Users{"joe": "123"}
+	auth := func(password string) error {
+		server, client := net.Pipe()
+		go func() {
+			Process(server, config, nil)
+			server.Close()
+		}()
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		c, err := smtp.NewClient(client, "localhost")
+		if err != nil {
+			return err
+		}
+		err = c.Auth(smtp.CRAMMD5Auth("joe", password))
+		if err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+
+	err := auth("123")
+	if err != nil {
+		t.Error(err)
+	}
+	err = auth("124")
+	if err == nil {
+		t.Error("expected an error for a wrong password")
+	}
+}
+
+func TestStarttls(t *testing.T) {
+	config, _ := testConfig(t)
+	config.Auth = testutil.Users{"joe": "123"}
+	server, client := net.Pipe()
+	defer client.Close()
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{testutil.Cert(t)}}
+	starttls := func() (io.ReadWriter, error) {
+		conn := tls.Server(server, tlsConfig)
+		return conn, conn.Handshake()
+	}
+	go func() {
+		Process(server, config, starttls)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Sends a command and returns the final line of the reply.
+	c := textproto.NewConn(client)
+	cmd := func(line string) string {
+		c.PrintfLine("%s", line)
+		for {
+			reply, err := c.ReadLine()
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			if len(reply) < 4 || reply[3] != '-' {
+				return reply
+			}
+		}
+	}
+	c.ReadLine()
+	cmd("EHLO client")
+	cmd("AUTH PLAIN AGpvZQAxMjM=")
+	cmd("MAIL FROM:<joe@localhost>")
+	if r := cmd("STARTTLS"); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("unexpected reply: %q", r)
+	}
+
+	conn := tls.Client(client, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = textproto.NewConn(conn)
+
+	// The client has to introduce itself again, the transaction
+	// is gone, and the client is not authenticated anymore.
+	expected := []struct{ cmd, reply string }{
+		{"MAIL FROM:<joe@localhost>", "503 5.5.1"},
+		{"EHLO client", "250 ENHANCEDSTATUSCODES"},
+		{"RCPT TO:<bob@localhost>", "503 5.5.1"},
+		{"STARTTLS", "503 5.5.1"},
+		{"AUTH PLAIN AGpvZQAxMjM=", "235 2.7.0"},
+		{"QUIT", "221 2.0.0"},
+	}
+	for _, e := range expected {
+		if r := cmd(e.cmd); !strings.HasPrefix(r, e.reply) {
+			t.Errorf("%s: expected %s, got %q", e.cmd, e.reply, r)
+		}
+	}
+}
+
+func TestListPartialDelivery(t *testing.T) {
+	config, box := testConfig(t)
+
+	// A mailbox that can't be written to: its
+	// directory is replaced with a file.
+	path := t.TempDir() + "/broken"
+	broken, err := mailbox.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Lookup = func(addr *Address) ([]*mailbox.Mailbox, error) {
+		return []*mailbox.Mailbox{broken, box}, nil
+	}
+	reports := make([]string, 0)
+	config.Notify = func(sender string, text io.Reader) error {
+		b, err := ioutil.ReadAll(text)
+		reports = append(reports, string(b))
+		return err
+	}
+
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<staff@localhost>\r\n" +
+		"DATA\r\n" +
+		"Subject: hi\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+	codes := replyCodes(conn.String())
+	if strings.Join(codes, " ") != "220 250 250 250 354 250 221" {
+		t.Errorf("unexpected replies: %v", codes)
+	}
+
+	// The member after the broken box gets the message,
+	// and the sender is told about the failed one.
+	if len(messages(t, box)) != 1 {
+		t.Errorf("the message is not delivered to the second member")
+	}
+	if len(reports) != 1 || !strings.Contains(reports[0], "Action: failed") || !strings.Contains(reports[0], "Status: 5.2.0") {
+		t.Errorf("expected a failure report, got %q", reports)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	config, box := testConfig(t)
+	config.MaxSize = 100
+	big := strings.Repeat("x", 200)
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"MAIL FROM:<joe@example.net> SIZE=101\r\n" +
+		"MAIL FROM:<joe@example.net> SIZE=abc\r\n" +
+		"MAIL FROM:<joe@example.net> SIZE=100\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"DATA\r\n" +
+		"Subject: big\r\n\r\n" + big + "\r\n.\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		fmt.Sprintf("BDAT %d LAST\r\n%s", len(big), big) +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"DATA\r\n" +
+		"Subject: small\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+
+	all := conn.String()
+	if !strings.Contains(all, "SIZE 100\r\n") {
+		t.Errorf("SIZE is not advertised: %q", all)
+	}
+	// Messages over the limit are rejected, and the
+	// session goes on with the next transaction.
+	expected := "220 250 552 501 250 250 354 552 250 250 552 250 250 354 250 221"
+	if codes := replyCodes(all); strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+	if strings.Count(all, "552 5.3.4 ") != 3 {
+		t.Errorf("expected 552 5.3.4 replies: %q", all)
+	}
+	texts := messages(t, box)
+	if len(texts) != 1 || !strings.Contains(texts[0], "Subject: small") {
+		t.Errorf("unexpected mailbox contents: %q", texts)
+	}
+}
+
+func TestLookupError(t *testing.T) {
+	config, _ := testConfig(t)
+	config.Lookup = func(addr *Address) ([]*mailbox.Mailbox, error) {
+		if addr.Name == "nobody" {
+			return nil, ErrUnknownRecipient
+		}
+		return nil, errors.New("open /var/mail/bob: permission denied")
+	}
+
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<nobody@localhost>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+	out := conn.String()
+
+	// Unknown recipients are refused for good, and other
+	// errors are temporary and not shown to the client.
+	if !strings.Contains(out, "\r\n550 5.1.1 No such user here\r\n") {
+		t.Errorf("no 550 reply for the unknown recipient: %q", out)
+	}
+	if !strings.Contains(out, "\r\n451 4.3.0 ") || strings.Contains(out, "permission denied") {
+		t.Errorf("expected a 451 reply without the error: %q", out)
+	}
+}
+
+func TestSubmissionPolicy(t *testing.T) {
+	config, box := testConfig(t)
+	config.Auth = testutil.Users{"joe": "123"}
+	config.RequireAuth = true
+	config.RequireTLS = true
+	script := "EHLO client\r\n" +
+		"MAIL FROM:<joe@localhost>\r\n" +
+		"AUTH PLAIN AGpvZQAxMjM=\r\n" +
+		"QUIT\r\n"
+
+	// Without TLS neither mail nor credentials are accepted.
+	conn := &testutil.Recorder{Reader: strings.NewReader(script)}
+	Process(conn, config, nil)
+	all := conn.String()
+	codes := replyCodes(all)
+	if strings.Join(codes, " ") != "220 250 530 538 221" {
+		t.Errorf("unexpected replies: %v", codes)
+	}
+	if strings.Contains(all, "AUTH PLAIN") {
+		t.Errorf("AUTH is advertised without TLS: %q", all)
+	}
+
+	config.TLS = true
+	script = "EHLO client\r\n" +
+		"MAIL FROM:<joe@localhost>\r\n" +
+		"AUTH PLAIN AGpvZQAxMjM=\r\n" +
+		"MAIL FROM:<joe@localhost>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"RCPT TO:<alice@example.net>\r\n" +
+		"DATA\r\n" +
+		"Subject: hi\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n"
+	conn = &testutil.Recorder{Reader: strings.NewReader(script)}
+	Process(conn, config, nil)
+	codes = replyCodes(conn.String())
+
+	// Relaying is not configured, so the remote recipient is
+	// refused even though the client has authenticated.
+	expected := "220 250 530 235 250 250 550 354 250 221"
+	if strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+	if len(messages(t, box)) != 1 {
+		t.Errorf("the message is not delivered")
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	config, _ := testConfig(t)
+	config.Auth = testutil.Users{"joe": "123"}
+	config.CheckSender = func(user string, addr *Address) bool {
+		return addr.Name == user && addr.Host == "localhost"
+	}
+	script := "EHLO client\r\n" +
+		"MAIL FROM:<bob@localhost>\r\n" +
+		"RSET\r\n" +
+		"AUTH PLAIN AGpvZQAxMjM=\r\n" +
+		"MAIL FROM:<bob@localhost>\r\n" +
+		"MAIL FROM:<>\r\n" +
+		"MAIL FROM:<joe@localhost>\r\n" +
+		"QUIT\r\n"
+
+	// Unauthenticated clients are not checked.
+	conn := &testutil.Recorder{Reader: strings.NewReader(script)}
+	Process(conn, config, nil)
+	all := conn.String()
+	expected := "220 250 250 250 235 553 553 250 221"
+	if codes := replyCodes(all); strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+	if !strings.Contains(all, "553 5.7.1 Sender address <bob@localhost> is not owned by joe\r\n") {
+		t.Errorf("unexpected rejection: %q", all)
+	}
+}
+
+func TestLocalDomains(t *testing.T) {
+	config, box := testConfig(t)
+	config.Hostname = "mail.example.com"
+	config.Domains = []string{"example.com"}
+	conn := &testutil.Recorder{Reader: strings.NewReader("EHLO client\r\n" +
+		"MAIL FROM:<joe@example.net>\r\n" +
+		"RCPT TO:<bob@localhost>\r\n" +
+		"RCPT TO:<bob@Mail.Example.Com>\r\n" +
+		"RCPT TO:<bob@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: hi\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n")}
+	Process(conn, config, nil)
+
+	all := conn.String()
+	if !strings.HasPrefix(all, "220 mail.example.com ready\r\n") {
+		t.Errorf("unexpected greeting: %q", all)
+	}
+	expected := "220 250 250 550 250 250 354 250 221"
+	if codes := replyCodes(all); strings.Join(codes, " ") != expected {
+		t.Errorf("expected %s, got %v", expected, codes)
+	}
+	texts := messages(t, box)
+	if len(texts) == 0 || !strings.Contains(texts[0], " by mail.example.com ;") {
+		t.Errorf("unexpected mailbox contents: %q", texts)
+	}
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import "strings"
+
+/*
+ * VRFY <string>
+ */
+func cmdVrfy(s *session, cmd *Command) {
+	if s.config.Verify == nil {
+		s.Reply(&Reply{502, "5.5.1", "VRFY is not available"})
+		return
+	}
+	addr, rerr := s.verifyArg(cmd.Arg)
+	if rerr != nil {
+		s.Reply(rerr)
+		return
+	}
+	user, err := s.config.Verify(addr)
+	if err != nil {
+		s.Reply(lookupError(err))
+		return
+	}
+	s.Reply(reply(250, "2.1.5", "<%s>", user.Format()))
+}
+
+/*
+ * EXPN <string>
+ */
+func cmdExpn(s *session, cmd *Command) {
+	if s.config.Expand == nil {
+		s.Reply(&Reply{502, "5.5.1", "EXPN is not available"})
+		return
+	}
+	addr, rerr := s.verifyArg(cmd.Arg)
+	if rerr != nil {
+		s.Reply(rerr)
+		return
+	}
+	members, err := s.config.Expand(addr)
+	if err != nil {
+		s.Reply(lookupError(err))
+		return
+	}
+	if len(members) == 0 {
+		s.Reply(&Reply{250, "2.1.5", "The list is empty"})
+		return
+	}
+	w := s.BeginBatch(250)
+	for _, member := range members {
+		w.Send("2.1.5 <%s>", member.Format())
+	}
+	w.End()
+}
+
+// verifyArg checks whether the session may use VRFY and EXPN
+// and parses their argument, which is either a name or an address.
+func (s *session) verifyArg(arg string) (*Address, *Reply) {
+	if !s.auth && !s.config.VerifyAnon {
+		return nil, &Reply{530, "5.7.0", "Authentication required"}
+	}
+	arg = strings.TrimSuffix(strings.TrimPrefix(arg, "<"), ">")
+	if arg == "" {
+		return nil, &Reply{ParameterSyntaxError, "5.5.4", "Argument expected"}
+	}
+	if !strings.Contains(arg, "@") {
+		return &Address{Name: arg}, nil
+	}
+	addr, err := parseAddress(arg)
+	if err != nil {
+		return nil, &Reply{ParameterSyntaxError, "5.1.3", "Malformed address"}
+	}
+	return addr, nil
+}
+
+func lookupError(err error) *Reply {
+	if err == ErrNotLocal {
+		return &Reply{551, "5.1.6", "Not a local address"}
+	}
+	return &Reply{550, "5.1.1", err.Error()}
+}